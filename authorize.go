@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/exp/slog"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+const authorizeDescription = "amz-ssh temporary access"
+
+// authorizeMyIP adds an ingress rule for ip to the bastion's first security
+// group, registering a cleanup that removes it again before exiting
+func authorizeMyIP(ctx context.Context, ec2Client *ec2.Client, bastion *sshutils.EC2Endpoint, ip string) error {
+	if len(bastion.Instance.SecurityGroups) == 0 {
+		return fmt.Errorf("bastion %s has no security groups to authorize", bastion.InstanceID)
+	}
+	groupID := aws.ToString(bastion.Instance.SecurityGroups[0].GroupId)
+
+	permission := ec2types.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int32(int32(bastion.Port)),
+		ToPort:     aws.Int32(int32(bastion.Port)),
+	}
+	if net.ParseIP(ip).To4() != nil {
+		permission.IpRanges = []ec2types.IpRange{{CidrIp: aws.String(ip + "/32"), Description: aws.String(authorizeDescription)}}
+	} else {
+		permission.Ipv6Ranges = []ec2types.Ipv6Range{{CidrIpv6: aws.String(ip + "/128"), Description: aws.String(authorizeDescription)}}
+	}
+
+	_, err := ec2Client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: []ec2types.IpPermission{permission},
+	})
+	var ae smithy.APIError
+	if errors.As(err, &ae) && ae.ErrorCode() == "InvalidPermission.Duplicate" {
+		// the rule isn't ours, so it mustn't be removed on exit
+		slog.Debug(fmt.Sprintf("%s is already allowed by %s", ip, groupID))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to authorize %s in %s: %w", ip, groupID, err)
+	}
+	slog.Info(fmt.Sprintf("allowed %s to port %d in %s until amz-ssh exits", ip, bastion.Port, groupID))
+
+	addCleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := ec2Client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: []ec2types.IpPermission{permission},
+		})
+		if err != nil {
+			slog.Error(fmt.Sprintf("unable to remove the rule for %s from %s, remove it by hand", ip, groupID), "err", err)
+			return
+		}
+		slog.Debug(fmt.Sprintf("removed the rule for %s from %s", ip, groupID))
+	})
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// printBanner returns a callback writing the server's pre-authentication
+// banner to out, such as an access warning from sshd's Banner setting
+func printBanner(out io.Writer) func(string) error {
+	return func(message string) error {
+		_, err := fmt.Fprint(out, message)
+		return err
+	}
+}
+
+// requireAck shows message and only returns nil once the user has typed yes
+func requireAck(message string, in io.Reader, out io.Writer) error {
+	fmt.Fprintln(out, message)
+	fmt.Fprint(out, "Type yes to continue: ")
+
+	answer, err := sshutils.ReadLine(in)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("the access banner was not acknowledged")
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRequireAckLeavesInput(t *testing.T) {
+	in := strings.NewReader("yes\nuptime\n")
+	if err := requireAck("Authorised use only", in, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "uptime\n" {
+		t.Errorf("input after the answer = %q, want %q", rest, "uptime\n")
+	}
+}
+
+func TestRequireAckRefused(t *testing.T) {
+	for _, answer := range []string{"no\n", "", "yes please\n"} {
+		if err := requireAck("Authorised use only", strings.NewReader(answer), io.Discard); err == nil {
+			t.Errorf("answer %q was accepted", answer)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// bastionCacheEntry is a resolved bastion instance id stored on disk so that
+// repeated invocations can skip the spot request and instance lookups
+type bastionCacheEntry struct {
+	InstanceID string    `json:"instance_id"`
+	Expires    time.Time `json:"expires"`
+}
+
+func bastionCacheKey(region, tagName, tagValue string) string {
+	return region + "/" + tagName + ":" + tagValue
+}
+
+func bastionCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "amz-ssh", "bastions.json"), nil
+}
+
+func loadBastionCache() map[string]bastionCacheEntry {
+	entries := map[string]bastionCacheEntry{}
+
+	path, err := bastionCachePath()
+	if err != nil {
+		return entries
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return entries
+	}
+
+	if err := json.Unmarshal(b, &entries); err != nil {
+		slog.Debug("ignoring unreadable bastion cache", "err", err)
+	}
+	return entries
+}
+
+func saveBastionCache(entries map[string]bastionCacheEntry) {
+	path, err := bastionCachePath()
+	if err != nil {
+		slog.Debug("unable to locate bastion cache", "err", err)
+		return
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		slog.Debug("unable to create bastion cache dir", "err", err)
+		return
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		slog.Debug("unable to write bastion cache", "err", err)
+	}
+}
+
+func getCachedBastion(key string) (string, bool) {
+	entry, ok := loadBastionCache()[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return "", false
+	}
+	return entry.InstanceID, true
+}
+
+func setCachedBastion(key, instanceID string, ttl time.Duration) {
+	entries := loadBastionCache()
+	for k, entry := range entries {
+		if time.Now().After(entry.Expires) {
+			delete(entries, k)
+		}
+	}
+	entries[key] = bastionCacheEntry{
+		InstanceID: instanceID,
+		Expires:    time.Now().Add(ttl),
+	}
+	saveBastionCache(entries)
+}
+
+// invalidateCachedBastion removes a cached bastion, it is a no-op for an empty key
+func invalidateCachedBastion(key string) {
+	if key == "" {
+		return
+	}
+	slog.Debug("invalidating cached bastion", "key", key)
+	entries := loadBastionCache()
+	delete(entries, key)
+	saveBastionCache(entries)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+)
+
+// cleanups undo changes made to AWS for the duration of the connection, they
+// are run on every way out of the program, including being interrupted
+var cleanups struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// addCleanup registers f to be run before exiting
+func addCleanup(f func()) {
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	cleanups.funcs = append(cleanups.funcs, f)
+}
+
+// runCleanups runs the registered cleanups in reverse order, each only once
+func runCleanups() {
+	cleanups.Lock()
+	funcs := cleanups.funcs
+	cleanups.funcs = nil
+	cleanups.Unlock()
+
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// commandRunning is set while an --exec command runs, interrupts are then left
+// to the command so that the tunnel stays up until it has exited
+var commandRunning atomic.Bool
+
+// execEnv describes the connection to commands run via --exec, so wrapped
+// tools can find the bastion and the local end of the tunnels. The first
+// tunnel is also given without a number.
+func execEnv(region string, bastion *sshutils.EC2Endpoint, tunnels []*sshutils.Forwarder) []string {
+	env := []string{
+		"AMZ_SSH_REGION=" + region,
+		"AMZ_SSH_BASTION_INSTANCE_ID=" + bastion.InstanceID,
+		"AMZ_SSH_BASTION_IP=" + bastion.Host(),
+		"AMZ_SSH_BASTION_PORT=" + strconv.Itoa(bastion.Port),
+		"AMZ_SSH_BASTION_USER=" + bastion.User,
+	}
+	for i, tunnel := range tunnels {
+		if i == 0 {
+			env = append(env,
+				"AMZ_SSH_TUNNEL_REMOTE="+tunnel.Remote.String(),
+				"AMZ_SSH_LOCAL_PORT="+strconv.Itoa(tunnel.LocalPort),
+			)
+		}
+		n := strconv.Itoa(i + 1)
+		env = append(env,
+			"AMZ_SSH_TUNNEL_"+n+"_REMOTE="+tunnel.Remote.String(),
+			"AMZ_SSH_LOCAL_PORT_"+n+"="+strconv.Itoa(tunnel.LocalPort),
+		)
+	}
+	return env
+}
+
+// runCommand runs the --exec command attached to the terminal with the
+// connection details added to its environment
+func runCommand(command []string, env []string) error {
+	if len(command) == 0 {
+		return errors.New("--exec needs a command to run, eg amz-ssh --exec -- psql")
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+
+	commandRunning.Store(true)
+	defer commandRunning.Store(false)
+
+	slog.Debug("Running " + cmd.String())
+	return cmd.Run()
+}
+
+// commandExitCode returns the exit code of a command run by runCommand, a
+// command killed by a signal is reported as a plain failure
+func commandExitCode(err *exec.ExitError) int {
+	if code := err.ExitCode(); code >= 0 {
+		return code
+	}
+	return 1
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestSignalledCommandExitStatus checks a remote command killed by a signal
+// is reported as 128+signum, which amz-ssh exits with, like a local shell
+func TestSignalledCommandExitStatus(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveExitSignal(listener, config, "KILL")
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "ec2-user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var ee *ssh.ExitError
+	if err := sess.Run("sleep 60"); !errors.As(err, &ee) {
+		t.Fatalf("expected an exit error, got %v", err)
+	}
+	if got := ee.ExitStatus(); got != 128+9 {
+		t.Errorf("exit status = %d, want %d", got, 128+9)
+	}
+}
+
+// serveExitSignal answers the first command on the first connection by
+// reporting it was killed by signal, without an exit status, as sshd does
+func serveExitSignal(listener net.Listener, config *ssh.ServerConfig, signal string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: signal}))
+				channel.Close()
+				return
+			}
+		}()
+	}
+}
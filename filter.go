@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/exp/slog"
+)
+
+// parseFilters parses --filter values in the AWS CLI's Name=...,Values=...
+// syntax. The flag's values are split on commas, so a value that doesn't start
+// with Name= is another of the previous filter's values.
+func parseFilters(values []string) ([]ec2types.Filter, error) {
+	var filters []ec2types.Filter
+	for _, value := range values {
+		if name, ok := strings.CutPrefix(value, "Name="); ok {
+			filters = append(filters, ec2types.Filter{Name: aws.String(name)})
+			continue
+		}
+		if len(filters) == 0 {
+			return nil, fmt.Errorf("%s is not a valid filter, use Name=name,Values=value1,value2", value)
+		}
+		value, _ = strings.CutPrefix(value, "Values=")
+		last := &filters[len(filters)-1]
+		last.Values = append(last.Values, value)
+	}
+
+	for _, filter := range filters {
+		if aws.ToString(filter.Name) == "" || len(filter.Values) == 0 {
+			return nil, fmt.Errorf("filter %s needs a name and values, use Name=name,Values=value1,value2", aws.ToString(filter.Name))
+		}
+	}
+	return filters, nil
+}
+
+// instanceFilters adds the running state to filters, unless they already
+// filter on the state
+func instanceFilters(filters []ec2types.Filter) []ec2types.Filter {
+	for _, filter := range filters {
+		if aws.ToString(filter.Name) == "instance-state-name" {
+			return filters
+		}
+	}
+	return append(filters[:len(filters):len(filters)], ec2types.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: []string{"running"},
+	})
+}
+
+// getInstances returns the instances matching filters from every page of results
+func getInstances(ctx context.Context, ec2Client *ec2.Client, filters []ec2types.Filter) ([]ec2types.Instance, error) {
+	var instances []ec2types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{
+		Filters: filters,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range page.Reservations {
+			instances = append(instances, res.Instances...)
+		}
+	}
+	return instances, nil
+}
+
+// resolveInstanceIDsByFilter returns every running instance matching filters
+// in the given order. Spot requests can't be filtered the same way, so the
+// instances are looked up directly.
+func resolveInstanceIDsByFilter(ctx context.Context, ec2Client *ec2.Client, filters []ec2types.Filter, order instanceOrder) ([]string, error) {
+	slog.Debug("Looking for instances matching --filter")
+	instances, err := getInstances(ctx, ec2Client, instanceFilters(filters))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, aws.ToString(instance.InstanceId))
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("unable to find any running instances matching --filter")
+	}
+
+	order(ids)
+	return ids, nil
+}
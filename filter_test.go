@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []ec2types.Filter
+		wantErr bool
+	}{
+		{
+			in:   []string{"Name=tag:role", "Values=bastion"},
+			want: []ec2types.Filter{{Name: aws.String("tag:role"), Values: []string{"bastion"}}},
+		},
+		{
+			// --filter Name=instance-type,Values=t3.micro,t3.small arrives split on commas
+			in:   []string{"Name=instance-type", "Values=t3.micro", "t3.small"},
+			want: []ec2types.Filter{{Name: aws.String("instance-type"), Values: []string{"t3.micro", "t3.small"}}},
+		},
+		{
+			in: []string{"Name=tag:role", "Values=bastion", "Name=availability-zone", "Values=eu-west-1a", "eu-west-1b"},
+			want: []ec2types.Filter{
+				{Name: aws.String("tag:role"), Values: []string{"bastion"}},
+				{Name: aws.String("availability-zone"), Values: []string{"eu-west-1a", "eu-west-1b"}},
+			},
+		},
+		{
+			in:   []string{"Name=tag:Name", "Values=bastion-*"},
+			want: []ec2types.Filter{{Name: aws.String("tag:Name"), Values: []string{"bastion-*"}}},
+		},
+		{in: nil, want: nil},
+		{in: []string{"Values=bastion"}, wantErr: true},
+		{in: []string{"Name=tag:role"}, wantErr: true},
+		{in: []string{"Name=", "Values=bastion"}, wantErr: true},
+		{in: []string{"Name=tag:role", "Values=bastion", "Name=instance-type"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFilters(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFilters(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFilters(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/exp/slog"
+)
+
+// runHook runs a --pre-connect or --post-disconnect command through the
+// shell. Its output goes to stderr, as stdout may be carrying the ssh stream
+// when amz-ssh is a ProxyCommand.
+func runHook(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	slog.Debug("Running hook " + cmd.String())
+	return cmd.Run()
+}
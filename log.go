@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/smithy-go/logging"
+	"golang.org/x/exp/slog"
+	"golang.org/x/term"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// newLogHandler creates the slog handler for --log-format
+func newLogHandler(format string, level slog.Level, w *os.File) (slog.Handler, error) {
+	opts := slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return opts.NewTextHandler(w), nil
+	case "json":
+		return opts.NewJSONHandler(w), nil
+	case "pretty":
+		// colours are only used on a terminal and never when NO_COLOR is set, see https://no-color.org
+		_, noColor := os.LookupEnv("NO_COLOR")
+		return &prettyHandler{
+			level: level,
+			color: !noColor && term.IsTerminal(int(w.Fd())),
+			mu:    &sync.Mutex{},
+			w:     w,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s is not a valid log format, use text, json or pretty", format)
+}
+
+// ANSI colours for each level, info is left in the terminal's own colour
+var levelColors = map[slog.Level]string{
+	slog.LevelDebug: "\033[90m",
+	slog.LevelWarn:  "\033[33m",
+	slog.LevelError: "\033[1;31m",
+}
+
+const colorReset = "\033[0m"
+
+// prettyHandler writes short human readable lines for interactive use, eg
+// "12:04:05 WARN  bastion connection lost err=EOF"
+type prettyHandler struct {
+	level  slog.Level
+	color  bool
+	attrs  []slog.Attr
+	prefix string
+
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if !r.Time.IsZero() {
+		b.WriteString(r.Time.Format("15:04:05 "))
+	}
+
+	level := fmt.Sprintf("%-5s", r.Level.String())
+	if color, ok := levelColors[r.Level]; ok && h.color {
+		level = color + level + colorReset
+	}
+	b.WriteString(level + " " + r.Message)
+
+	for _, a := range h.attrs {
+		writeAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%v", prefix, a.Key, a.Value.Any())
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		if h.prefix != "" {
+			a.Key = h.prefix + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// logTimings logs how long each phase of connecting took, to tell whether a
+// slow connection is down to the AWS APIs or the network. Phases can overlap,
+// resolving a hop includes pushing its key.
+func logTimings() {
+	for _, t := range sshutils.Timings() {
+		slog.Debug("timing", "phase", t.Phase, "took", t.Duration)
+	}
+}
+
+// awsLogger routes the SDK's --trace-aws request and response logging through
+// slog. The credentials in the signed requests are redacted.
+type awsLogger struct{}
+
+// awsSecretHeaders are the request headers that carry credentials
+var awsSecretHeaders = regexp.MustCompile(`(?mi)^((?:Authorization|X-Amz-Security-Token):)[^\r\n]*`)
+
+func (awsLogger) Logf(classification logging.Classification, format string, v ...interface{}) {
+	msg := awsSecretHeaders.ReplaceAllString(fmt.Sprintf(format, v...), "$1 REDACTED")
+	if classification == logging.Warn {
+		slog.Warn("aws", "trace", msg)
+		return
+	}
+	slog.Info("aws", "trace", msg)
+}
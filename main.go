@@ -2,19 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"math/big"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	connect "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	cli "github.com/urfave/cli/v2"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
@@ -22,7 +32,12 @@ import (
 	"github.com/mintel/amz-ssh/pkg/sshutils"
 )
 
-var version = "0.0.0"
+// set by goreleaser via ldflags
+var (
+	version = "0.0.0"
+	commit  = "none"
+	date    = "unknown"
+)
 
 func main() {
 	setupSignalHandlers()
@@ -30,8 +45,35 @@ func main() {
 		Name:      "amz-ssh",
 		Usage:     "connect to an AWS EC2 instance via ec2-instance-connect",
 		Version:   version,
+		Before:    setupLogging,
 		Action:    run,
-		UsageText: "amz-ssh [options] destination [destination...]\n\nDestination can be an IP address or instance ID.\nMultiple destinations will be treated as addition ssh proxies in addition to the ssh bastion.",
+		UsageText: "amz-ssh [options] destination [destination...]\n\nDestination can be an IP address, instance ID or tag:key=value, IP addresses authenticate with --identity or the ssh agent.\nMultiple destinations will be treated as addition ssh proxies in addition to the ssh bastion.\nA destination in another region can be given as [user@]instance[:port],region=eu-west-1\nThe key pushed to a destination can be chosen with ,key=ed25519 or ,key=rsa,bits=2048",
+		Commands: []*cli.Command{
+			{
+				Name:      "use",
+				Usage:     "connect with a named profile from the profiles file, or list the profiles",
+				ArgsUsage: "[profile] [destination...]",
+				Action:    useProfile,
+			},
+			{
+				Name:      "ping",
+				Usage:     "connect to the bastion, or through it to the destinations, run true and print how long it took, failing if it can't",
+				ArgsUsage: "[destination...]",
+				Action:    ping,
+			},
+			{
+				Name:      "push-key",
+				Usage:     "push a key to an instance via Instance Connect without connecting, a generated key's private key is printed",
+				ArgsUsage: "[destination]",
+				Action:    pushKey,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "public-key",
+						Usage: "OpenSSH public key file to push instead of generating one, - reads it from stdin",
+					},
+				},
+			},
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "region",
@@ -41,12 +83,20 @@ func main() {
 				Name:  "tag",
 				Value: "role:bastion",
 			},
+			&cli.StringSliceFlag{
+				Name:  "filter",
+				Usage: "find the bastion with this EC2 filter, eg Name=instance-type,Values=t3.micro,t3.small, can be repeated. It replaces --tag unless that's given too",
+			},
 			&cli.StringFlag{
 				Name:    "instance-id",
 				Aliases: []string{"i"},
 				Usage:   "instance id to ssh to or tunnel through",
 				Value:   "",
 			},
+			&cli.BoolFlag{
+				Name:  "pick",
+				Usage: "choose the instance to connect to from a filterable list of all running instances",
+			},
 			&cli.StringFlag{
 				Name:    "user",
 				Aliases: []string{"u"},
@@ -54,9 +104,59 @@ func main() {
 				Value:   "ec2-user",
 			},
 			&cli.StringFlag{
+				Name:  "identity",
+				Usage: "private key file to authenticate with when a key can't be pushed, such as for IP destinations",
+			},
+			&cli.StringFlag{
+				Name:  "pre-connect",
+				Usage: "run this shell command before looking anything up or connecting, such as to bring up a VPN, stopping if it fails",
+			},
+			&cli.StringFlag{
+				Name:  "post-disconnect",
+				Usage: "run this shell command once disconnected, including after an interrupt",
+			},
+			&cli.StringFlag{
+				Name:  "identity-agent",
+				Usage: "socket of the ssh agent to authenticate with instead of $SSH_AUTH_SOCK, such as 1Password's or gpg-agent's",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-config",
+				Usage: "take the User and Port of hosts from this OpenSSH config, such as ~/.ssh/config, when they aren't given, ProxyJump is ignored",
+			},
+			&cli.StringFlag{
+				Name:  "cert",
+				Usage: "OpenSSH user certificate for the --identity key, authenticating with it instead of pushing keys",
+			},
+			&cli.StringFlag{
+				Name:  "ca-key",
+				Usage: "sign the generated keys with this CA private key instead of pushing them, for servers with TrustedUserCAKeys",
+			},
+			&cli.DurationFlag{
+				Name:  "cert-validity",
+				Usage: "how long certificates signed with --ca-key are valid for",
+				Value: 5 * time.Minute,
+			},
+			&cli.Float64Flag{
+				Name:  "key-push-rate",
+				Usage: "most Instance Connect key pushes per second, to stay inside the account's API quota, 0 is unlimited",
+				Value: 2,
+			},
+			&cli.StringFlag{
+				Name:  "connect-user",
+				Usage: "OS user the Instance Connect key is pushed for, defaults to --user",
+			},
+			&cli.StringFlag{
+				Name:  "key-comment",
+				Usage: "comment for the pushed public key, {identity} and {timestamp} are replaced with the caller ARN and current time",
+			},
+			&cli.StringFlag{
+				Name:  "az",
+				Usage: "availability zone to push keys for instead of the instances' own, for Local Zone, Wavelength or Outposts instances",
+			},
+			&cli.StringSliceFlag{
 				Name:    "tunnel",
 				Aliases: []string{"t"},
-				Usage:   "Host to tunnel to",
+				Usage:   "Host to tunnel to, or imds for the bastion's instance metadata service, can be repeated",
 			},
 			&cli.IntFlag{
 				Name:    "port",
@@ -66,7 +166,256 @@ func main() {
 			&cli.IntFlag{
 				Name:    "local-port",
 				Aliases: []string{"lp"},
-				Usage:   "local port to map to, defaults to tunnel port",
+				Usage:   "local port to map to when there's a single tunnel, defaults to tunnel port",
+			},
+			&cli.StringFlag{
+				Name:  "resolve-on",
+				Usage: "where tunnel host names are resolved, remote by the bastion or local by this machine",
+				Value: "remote",
+			},
+			&cli.StringFlag{
+				Name:  "dns-server",
+				Usage: "resolve tunnel host names locally with this DNS server, implies --resolve-on local",
+			},
+			&cli.BoolFlag{
+				Name:  "random-port",
+				Usage: "listen for tunnels on free local ports picked by the OS instead of the remote ports",
+			},
+			&cli.StringFlag{
+				Name:  "bastion-host",
+				Usage: "connect to the bastion via this DNS name, such as a load balancer, pushing the key to every tagged bastion behind it",
+			},
+			&cli.StringFlag{
+				Name:  "control-path",
+				Usage: "reuse the OpenSSH ControlMaster socket at this path to reach past the bastion, when it exists",
+			},
+			&cli.StringFlag{
+				Name:    "network-interface",
+				Aliases: []string{"eni"},
+				Usage:   "network interface id or secondary private IP of the last instance in the chain to connect to",
+			},
+			&cli.BoolFlag{
+				Name:  "use-private",
+				Usage: "connect to the bastion via its private IP, for use from inside the VPC or over a VPN",
+			},
+			&cli.BoolFlag{
+				Name:  "use-dns",
+				Usage: "connect to the bastion by its DNS name, combine with --use-private for its private DNS name",
+			},
+			&cli.BoolFlag{
+				Name:  "prefer-ipv6",
+				Usage: "use IPv6 addresses for private connections when instances have one",
+			},
+			&cli.StringFlag{
+				Name:  "address-family",
+				Usage: "dial only over inet (IPv4) or inet6 (IPv6), for dual-stack networks where the other is firewalled, or auto for either",
+				Value: "auto",
+			},
+			&cli.BoolFlag{
+				Name:  "proxy-protocol",
+				Usage: "send a PROXY protocol v2 header with the local client address on each tunnelled connection",
+			},
+			&cli.StringFlag{
+				Name:  "rate-limit",
+				Usage: "limit tunnel throughput, eg 1MB/s",
+			},
+			&cli.StringFlag{
+				Name:  "rate-limit-scope",
+				Usage: "apply --rate-limit to each `connection` or to the aggregate of all connections",
+				Value: "connection",
+			},
+			&cli.IntFlag{
+				Name:  "ready-fd",
+				Usage: "write a READY line to this file descriptor once the tunnel and bastion connection are up",
+			},
+			&cli.BoolFlag{
+				Name:  "exec",
+				Usage: "run the command given after -- with the connection details in its environment, after opening any tunnel",
+			},
+			&cli.DurationFlag{
+				Name:  "drain-timeout",
+				Usage: "how long to wait for active tunnel connections to finish when stopping",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "heartbeat",
+				Usage: "log the tunnel status at this interval, reconnecting to the bastion if needed",
+			},
+			&cli.StringSliceFlag{
+				Name:    "local-forward",
+				Aliases: []string{"L"},
+				Usage:   "forward [bind:]port:host:hostport from here via the last destination, like ssh -L",
+			},
+			&cli.StringSliceFlag{
+				Name:    "remote-forward",
+				Aliases: []string{"R"},
+				Usage:   "forward [bind:]port:host:hostport on the last destination back to here, like ssh -R",
+			},
+			&cli.StringSliceFlag{
+				Name:    "dynamic-forward",
+				Aliases: []string{"D"},
+				Usage:   "run a SOCKS5 proxy on [bind:]port connecting via the last destination, like ssh -D",
+			},
+			&cli.StringSliceFlag{
+				Name:  "udp-forward",
+				Usage: "forward UDP on [bind:]port to TCP host:hostport via the last destination, datagrams are length prefixed as DNS over TCP expects",
+			},
+			&cli.BoolFlag{
+				Name:  "udp-raw",
+				Usage: "send --udp-forward datagrams without a length prefix, for a relay such as socat on the remote",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allow",
+				Usage: "only let tunnels and the SOCKS proxy connect to this CIDR, IP or *.domain with an optional :port, can be repeated",
+			},
+			&cli.BoolFlag{
+				Name:    "no-shell",
+				Aliases: []string{"N"},
+				Usage:   "only forward ports without opening a shell, like ssh -N",
+			},
+			&cli.BoolFlag{
+				Name:  "no-escapes",
+				Usage: "don't treat ~ at the start of a line in the shell as an escape, such as ~C to add a forward",
+			},
+			&cli.StringFlag{
+				Name:  "command",
+				Usage: "run this command on the last destination, or on every host of --hosts-file, instead of opening a shell",
+			},
+			&cli.StringFlag{
+				Name:  "hosts-file",
+				Usage: "file of destinations, one per line, to run --command on at the same time",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "how many destinations are looked up, and hosts run --command, at once",
+				Value: 10,
+			},
+			&cli.StringFlag{
+				Name:  "output-prefix",
+				Usage: "label each line of --command output with the host's id, Name tag or none, defaults to id for several hosts",
+			},
+			&cli.BoolFlag{
+				Name:  "buffer-output",
+				Usage: "write each host's --command output once it has finished, rather than as it arrives",
+			},
+			&cli.BoolFlag{
+				Name:  "no-pty",
+				Usage: "never request a pty for the shell, even when stdin is a terminal",
+			},
+			&cli.BoolFlag{
+				Name:  "force-pty",
+				Usage: "request a pty for the shell even when stdin isn't a terminal",
+			},
+			&cli.StringFlag{
+				Name:  "record",
+				Usage: "record the shell session to this asciinema cast file while showing it",
+			},
+			&cli.StringFlag{
+				Name:  "audit-input",
+				Usage: "append everything typed into the shell, passwords included, to this file for auditing",
+			},
+			&cli.BoolFlag{
+				Name:  "shell",
+				Usage: "open a shell alongside the tunnels, sharing the same bastion connection, implied when there are destinations",
+			},
+			&cli.DurationFlag{
+				Name:  "aws-timeout",
+				Usage: "how long each AWS lookup or key push may take before giving up, 0 waits indefinitely",
+				Value: 30 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "avoid-interruption",
+				Usage: "when resolving the bastion from --tag, try spot instances with a pending interruption last and prefer on-demand instances while any have one",
+			},
+			&cli.DurationFlag{
+				Name:  "cache-ttl",
+				Usage: "cache the bastion resolved from --tag on disk for this long, 0 disables the cache",
+			},
+			&cli.StringSliceFlag{
+				Name:  "ciphers",
+				Usage: "ssh ciphers to allow, in order of preference",
+			},
+			&cli.StringSliceFlag{
+				Name:  "macs",
+				Usage: "ssh MACs to allow, in order of preference",
+			},
+			&cli.StringSliceFlag{
+				Name:  "kex",
+				Usage: "ssh key exchange algorithms to allow, in order of preference",
+			},
+			&cli.StringFlag{
+				Name:  "client-version",
+				Usage: "ssh identification string sent to servers, defaults to SSH-2.0-Go amz-ssh/<version>",
+			},
+			&cli.BoolFlag{
+				Name:  "fips",
+				Usage: "only negotiate FIPS approved ssh algorithms",
+			},
+			&cli.StringFlag{
+				Name:  "host-key-fingerprint",
+				Usage: "only accept a bastion whose host key has this SHA256 fingerprint, as shown by ssh-keygen -lf, destinations pin their own with hostkey=",
+			},
+			&cli.BoolFlag{
+				Name:  "keyboard-interactive",
+				Usage: "answer keyboard-interactive challenges from the servers, such as an MFA code, on the terminal",
+			},
+			&cli.StringFlag{
+				Name:    "require-ack",
+				Usage:   "show this message and require typing yes before the shell starts",
+				EnvVars: []string{"AMZ_SSH_REQUIRE_ACK"},
+			},
+			&cli.BoolFlag{
+				Name:  "sso-login",
+				Usage: "run `aws sso login` automatically when the SSO session has expired",
+			},
+			&cli.BoolFlag{
+				Name:  "transport-only",
+				Usage: "pipe stdio to the bastion's ssh port without pushing a key, for use as an ssh ProxyCommand",
+			},
+			&cli.BoolFlag{
+				Name:  "show-source-ip",
+				Usage: "log the IP the bastion connection comes from, locally and as AWS sees it, for security group rules",
+			},
+			&cli.BoolFlag{
+				Name:  "authorize-my-ip",
+				Usage: "temporarily allow your public IP to the bastion's ssh port in its security group, removed on exit",
+			},
+			&cli.BoolFlag{
+				Name:  "deterministic",
+				Usage: "pick the instance with the lowest id when several match a tag, rather than one at random",
+			},
+			&cli.StringFlag{
+				Name:  "select",
+				Usage: "which bastion to use when several match: newest or oldest launched, random, or first by id. Tag destinations are only ordered by first, otherwise random",
+				Value: "random",
+			},
+			&cli.BoolFlag{
+				Name:  "show-instance-info",
+				Usage: "print the instance's name, type, availability zone and launch time once connected",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "resolve the instances and print the connection plan without connecting or pushing keys",
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "only log warnings and errors, for scripting",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Usage: "log as text, json or pretty, pretty is coloured on a terminal unless NO_COLOR is set",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:    "profiles",
+				Usage:   "JSON file of named profiles for the use command",
+				EnvVars: []string{"AMZ_SSH_PROFILES"},
+				Value:   defaultProfilesPath(),
+			},
+			&cli.BoolFlag{
+				Name:  "trace-aws",
+				Usage: "log every AWS API request, response and retry, for debugging IAM and throttling errors",
 			},
 			&cli.BoolFlag{
 				Name:  "debug",
@@ -75,86 +424,1031 @@ func main() {
 		},
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		if ee, ok := err.(*ssh.ExitError); ok {
-			os.Exit(ee.ExitStatus())
+	cli.VersionPrinter = func(c *cli.Context) {
+		commit, date := buildInfo()
+		fmt.Fprintf(c.App.Writer, "%s version %s (commit %s, built %s, %s %s/%s)\n",
+			c.App.Name, c.App.Version, commit, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	}
+
+	os.Exit(exitStatus(app.Run(os.Args)))
+}
+
+// exitStatus runs the cleanups, so that changes such as --authorize-my-ip
+// are undone however amz-ssh fails, and returns the status to exit with
+func exitStatus(err error) int {
+	runCleanups()
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*ssh.ExitError); ok {
+		// a remote process killed by a signal is reported as 128+signum by
+		// the ssh package, following the shell convention
+		return ee.ExitStatus()
+	}
+	var ce *exec.ExitError
+	if errors.As(err, &ce) {
+		return commandExitCode(ce)
+	}
+	slog.Error(err.Error())
+	return 1
+}
+
+// buildInfo returns the commit and build date, falling back to what the Go
+// toolchain recorded when built from source rather than by goreleaser
+func buildInfo() (string, string) {
+	commit, date := commit, date
+	fromVCS := commit == "none"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return commit, date
+	}
+
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && fromVCS:
+			commit = setting.Value
+		case setting.Key == "vcs.time" && date == "unknown":
+			date = setting.Value
+		case setting.Key == "vcs.modified" && setting.Value == "true" && fromVCS:
+			commit += "-dirty"
 		}
-		slog.Error(err.Error())
-		os.Exit(1)
 	}
+	return commit, date
 }
+
 func setupSignalHandlers() {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		fmt.Println("\nGoodbye!")
-		os.Exit(0)
+		for range c {
+			if commandRunning.Load() {
+				continue
+			}
+			runCleanups()
+			// stdout only carries the remote session, eg when used as a ProxyCommand
+			if slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+				fmt.Fprintln(os.Stderr, "\nGoodbye!")
+			}
+			os.Exit(0)
+		}
 	}()
 }
 
-func run(c *cli.Context) error {
+// setupLogging configures slog for every command from the logging flags
+func setupLogging(c *cli.Context) error {
 	level := slog.LevelInfo
+	if c.Bool("quiet") {
+		level = slog.LevelWarn
+	}
 	if c.Bool("debug") {
 		level = slog.LevelDebug
 	}
-	h := slog.HandlerOptions{Level: level}.NewTextHandler(os.Stderr)
+	h, err := newLogHandler(c.String("log-format"), level, os.Stderr)
+	if err != nil {
+		return err
+	}
 	slog.SetDefault(slog.New(h))
+	return nil
+}
 
-	var tagName string
-	var tagValue string
+// parseTag splits a key:value tag definition
+func parseTag(tag string) (string, string, error) {
+	if parts := strings.Split(tag, ":"); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("%s is not a valid tag definition, use key:value", tag)
+}
 
-	if parts := strings.Split(c.String("tag"), ":"); len(parts) == 2 {
-		tagName = parts[0]
-		tagValue = parts[1]
-	} else {
-		return fmt.Errorf("%s is not a valid tag definition, use key:value", c.String("tag"))
+func run(c *cli.Context) error {
+	return connect(c, c.Args().Slice())
+}
+
+// connect does the work of run with the destinations given, so that they can
+// also come from a profile
+func connect(c *cli.Context, args []string) error {
+	if hook := c.String("pre-connect"); hook != "" {
+		if err := runHook(hook); err != nil {
+			return fmt.Errorf("--pre-connect command failed: %w", err)
+		}
+	}
+	if hook := c.String("post-disconnect"); hook != "" {
+		// as a cleanup it also runs when interrupted or on errors
+		addCleanup(func() {
+			if err := runHook(hook); err != nil {
+				slog.Warn("--post-disconnect command failed", "err", err)
+			}
+		})
+	}
+
+	tagName, tagValue, err := parseTag(c.String("tag"))
+	if err != nil {
+		return err
 	}
 
-	ec2Client, connectClient := getClients(c.Context, c.String("region"))
+	cfg, err := loadConfig(c.Context, c.String("region"), c.Bool("sso-login"), c.Bool("trace-aws"))
+	if err != nil {
+		return err
+	}
+	// newest and oldest need launch times, so they only apply to the bastion
+	// and tag destinations are ordered as for random
+	order := shuffleInstances
+	switch c.String("select") {
+	case "random":
+		if c.Bool("deterministic") {
+			order = sortInstances
+		}
+	case "first":
+		order = sortInstances
+	case "newest", "oldest":
+	default:
+		return fmt.Errorf("%s is not a way to select instances, use newest, oldest, random or first", c.String("select"))
+	}
 
+	sshutils.SetKeyPushRate(c.Float64("key-push-rate"))
+	if err := sshutils.SetAddressFamily(c.String("address-family")); err != nil {
+		return err
+	}
+	if c.Bool("debug") {
+		addCleanup(logTimings)
+	}
+	// every hop authenticating with the agent shares one connection to it
+	addCleanup(sshutils.CloseAgents)
+
+	clients := sshutils.NewClients(cfg)
+	ec2Client, connectClient := clients.EC2(""), clients.Connect("")
+	awsTimeout := c.Duration("aws-timeout")
+
+	// cacheKey is only set when the bastion came from the cache, so that it
+	// can be invalidated if connecting to it fails
+	var cacheKey string
+	// candidates are the other bastions to fail over to, in the order tried
+	var candidates []string
+	ttl := c.Duration("cache-ttl")
+	if c.String("bastion-host") != "" {
+		// every bastion behind the host needs the key, not just a cached one
+		ttl = 0
+	}
+	filters, err := parseFilters(c.StringSlice("filter"))
+	if err != nil {
+		return err
+	}
+	if len(filters) > 0 && c.IsSet("tag") {
+		filters = append(filters, ec2types.Filter{
+			Name:   aws.String("tag:" + tagName),
+			Values: []string{tagValue},
+		})
+	}
+	key := bastionCacheKey(cfg.Region, tagName, tagValue)
+	if len(filters) > 0 {
+		key = cfg.Region + "/" + strings.Join(c.StringSlice("filter"), ",")
+	}
 	instanceID := c.String("instance-id")
+	if c.Bool("pick") {
+		if instanceID != "" {
+			return errors.New("--pick can't be combined with --instance-id")
+		}
+		ctx, cancel := withTimeout(c.Context, awsTimeout)
+		instances, err := listRunningInstances(ctx, ec2Client)
+		cancel()
+		if err != nil {
+			return timeoutError(err, awsTimeout)
+		}
+		if instanceID, err = pickInstance(instances, os.Stdin, os.Stderr); err != nil {
+			return err
+		}
+	}
 	if instanceID == "" {
-		var err error
-		instanceID, err = resolveBastionInstanceID(c.Context, ec2Client, tagName, tagValue)
+		if ttl > 0 {
+			if cached, ok := getCachedBastion(key); ok {
+				slog.Debug("Using cached bastion " + cached)
+				instanceID = cached
+				cacheKey = key
+			}
+		}
+
+		if instanceID == "" {
+			start := time.Now()
+			ctx, cancel := withTimeout(c.Context, awsTimeout)
+			bastionOrder := order
+			if mode := c.String("select"); mode == "newest" || mode == "oldest" {
+				bastionOrder = launchTimeOrder(ctx, ec2Client, mode == "newest")
+			}
+			if len(filters) > 0 {
+				candidates, err = resolveInstanceIDsByFilter(ctx, ec2Client, filters, bastionOrder)
+			} else {
+				candidates, err = resolveInstanceIDsByTag(ctx, ec2Client, tagName, tagValue, bastionOrder)
+			}
+			if err == nil && c.Bool("avoid-interruption") && len(filters) == 0 {
+				candidates, err = avoidInterruptions(ctx, ec2Client, tagName, tagValue, candidates, bastionOrder)
+			}
+			cancel()
+			if err != nil {
+				return timeoutError(err, awsTimeout)
+			}
+			sshutils.RecordTiming("find bastion", start)
+			instanceID, candidates = candidates[0], candidates[1:]
+			if ttl > 0 {
+				setCachedBastion(key, instanceID, ttl)
+			}
+		}
+	}
+
+	clientOpts := sshutils.ClientOptions{
+		Config: ssh.Config{
+			Ciphers:      c.StringSlice("ciphers"),
+			MACs:         c.StringSlice("macs"),
+			KeyExchanges: c.StringSlice("kex"),
+		},
+		Timeout:             dialTimeout,
+		ClientVersion:       c.String("client-version"),
+		KeyboardInteractive: c.Bool("keyboard-interactive"),
+		IdentityAgent:       c.String("identity-agent"),
+	}
+	if !c.Bool("quiet") {
+		clientOpts.BannerCallback = printBanner(os.Stderr)
+	}
+	if clientOpts.ClientVersion == "" {
+		clientOpts.ClientVersion = "SSH-2.0-Go amz-ssh/" + version
+	} else if !strings.HasPrefix(clientOpts.ClientVersion, "SSH-2.0-") {
+		clientOpts.ClientVersion = "SSH-2.0-" + clientOpts.ClientVersion
+	}
+	if c.Bool("fips") {
+		if err := clientOpts.RestrictToFIPS(); err != nil {
+			return err
+		}
+	}
+	if c.String("cert") != "" && c.String("ca-key") != "" {
+		return errors.New("--cert and --ca-key can't be combined, use one or the other")
+	}
+	if c.String("cert") != "" && c.String("identity") == "" {
+		return errors.New("--cert needs the certificate's private key given with --identity")
+	}
+	if c.String("identity") != "" {
+		identity, err := sshutils.LoadIdentity(c.String("identity"))
+		if err != nil {
+			return fmt.Errorf("unable to load identity: %w", err)
+		}
+		if cert := c.String("cert"); cert != "" {
+			if identity, err = sshutils.LoadCertificate(cert, identity); err != nil {
+				return fmt.Errorf("unable to load certificate: %w", err)
+			}
+		}
+		clientOpts.Identities = append(clientOpts.Identities, identity)
+	}
+
+	endpointOpts := []sshutils.EC2EndpointOption{
+		sshutils.WithClients(clients),
+		sshutils.WithClientOptions(clientOpts),
+		sshutils.WithAWSTimeout(awsTimeout),
+	}
+	// the certificate is what authenticates, so no key is generated or pushed
+	if c.String("cert") != "" {
+		endpointOpts = append(endpointOpts, sshutils.WithoutKeys())
+	}
+	if path := c.String("ca-key"); path != "" {
+		ca, err := sshutils.LoadIdentity(path)
+		if err != nil {
+			return fmt.Errorf("unable to load CA key: %w", err)
+		}
+		endpointOpts = append(endpointOpts, sshutils.WithCA(ca, c.Duration("cert-validity")))
+	}
+	// with --exec the arguments are the command to run rather than destinations
+	var command []string
+	if c.Bool("exec") {
+		if c.Bool("shell") {
+			return errors.New("--exec can't be combined with --shell")
+		}
+		args, command = nil, args
+	}
+	if c.String("hosts-file") != "" {
+		if c.String("command") == "" {
+			return errors.New("--hosts-file needs a --command to run on each host")
+		}
+		if len(args) > 0 {
+			return errors.New("--hosts-file can't be combined with destinations, put them in the file")
+		}
+	}
+	if c.String("command") != "" && (c.Bool("exec") || len(c.StringSlice("tunnel")) > 0) {
+		return errors.New("--command can't be combined with --exec or --tunnel")
+	}
+	switch c.String("output-prefix") {
+	case "", "none", "id", "name":
+	default:
+		return fmt.Errorf("%s is not a valid output prefix, use none, id or name", c.String("output-prefix"))
+	}
+	if c.Bool("no-pty") && c.Bool("force-pty") {
+		return errors.New("--no-pty and --force-pty can't be combined")
+	}
+
+	if c.Bool("transport-only") {
+		if len(args) > 0 || len(c.StringSlice("tunnel")) > 0 {
+			return errors.New("--transport-only can't be combined with destinations or tunnels")
+		}
+		endpointOpts = append(endpointOpts, sshutils.WithoutKeys())
+	}
+	if c.String("key-comment") != "" {
+		comment, err := keyComment(c.Context, cfg, c.String("key-comment"))
 		if err != nil {
 			return err
 		}
+		endpointOpts = append(endpointOpts, sshutils.WithKeyComment(comment))
+	}
+	if az := c.String("az"); az != "" {
+		endpointOpts = append(endpointOpts, sshutils.WithAvailabilityZone(az))
+	}
+
+	var sshCfg *sshConfig
+	if path := c.String("ssh-config"); path != "" {
+		if sshCfg, err = loadSSHConfig(expandHome(path)); err != nil {
+			return fmt.Errorf("unable to read ssh config: %w", err)
+		}
 	}
 
-	bastionAddr := fmt.Sprintf("%s@%s:%d", c.String("user"), instanceID, c.Int("port"))
-	bastionEndpoint, err := sshutils.NewEC2Endpoint(c.Context, bastionAddr, ec2Client, connectClient)
+	newBastion := func(instanceID string) (*sshutils.EC2Endpoint, error) {
+		bastionAddr := fmt.Sprintf("%s@%s:%d", c.String("user"), instanceID, c.Int("port"))
+		ctx, cancel := withTimeout(c.Context, awsTimeout)
+		defer cancel()
+		bastion, err := sshutils.NewEC2Endpoint(ctx, bastionAddr, ec2Client, connectClient, endpointOpts...)
+		if err != nil {
+			return nil, timeoutError(err, awsTimeout)
+		}
+		bastion.UsePrivate = c.Bool("use-private")
+		bastion.ConnectUser = c.String("connect-user")
+		bastion.PreferIPv6 = c.Bool("prefer-ipv6") || c.String("address-family") == "inet6"
+		bastion.UseDNS = c.Bool("use-dns")
+		// destinations only pin the host keys given with their own hostkey=
+		bastion.HostKeyFingerprint = c.String("host-key-fingerprint")
+
+		// explicit flags win over ssh_config
+		user, port := sshCfg.defaults(instanceID, bastion.Host(), c.String("bastion-host"))
+		if user != "" && !c.IsSet("user") {
+			bastion.User = user
+		}
+		if port != 0 && !c.IsSet("port") {
+			bastion.Port = port
+		}
+		return bastion, nil
+	}
+
+	bastionEndpoint, err := newBastion(instanceID)
 	if err != nil {
+		invalidateCachedBastion(cacheKey)
 		return err
 	}
 
-	if tunnel := sshutils.NewEndpoint(c.String("tunnel")); tunnel.Host != "" {
-		p := c.Int("local-port")
-		if p == 0 {
-			p = tunnel.Port
+	// behind a load balancer the connection may land on any of the bastions,
+	// so each of them is sent the key and there's nothing to fail over to
+	if host := c.String("bastion-host"); host != "" {
+		bastionEndpoint.Hostname = host
+		for _, id := range candidates {
+			ctx, cancel := withTimeout(c.Context, awsTimeout)
+			err := bastionEndpoint.AddBackend(ctx, id)
+			cancel()
+			if err != nil {
+				return timeoutError(err, awsTimeout)
+			}
 		}
-		return sshutils.Tunnel(p, tunnel, bastionEndpoint)
+		candidates = nil
+	}
+
+	if c.Bool("authorize-my-ip") && c.Bool("use-private") {
+		return errors.New("--authorize-my-ip only applies to connecting over the bastion's public IP")
 	}
+	var myIP string
 
-	chain := []sshutils.EndpointIface{
-		bastionEndpoint,
+	// dialBastion connects to the bastion, failing over to the next candidate
+	// when one can't be reached
+	dialBastion := func() (*ssh.Client, error) {
+		for {
+			if c.Bool("authorize-my-ip") {
+				if myIP == "" {
+					ip, err := publicIP(c.Context)
+					if err != nil {
+						return nil, err
+					}
+					myIP = ip
+				}
+				if err := authorizeMyIP(c.Context, ec2Client, bastionEndpoint, myIP); err != nil {
+					return nil, err
+				}
+			}
+
+			client, err := sshutils.Dial(bastionEndpoint)
+			if err == nil {
+				if c.Bool("show-source-ip") {
+					reportSourceIP(c.Context, client)
+				}
+				return client, nil
+			}
+			invalidateCachedBastion(cacheKey)
+			if c.Bool("show-source-ip") {
+				if ip, err := publicIP(c.Context); err == nil {
+					slog.Info("connections to the bastion are seen by AWS as coming from " + ip)
+				}
+			}
+			if len(candidates) == 0 {
+				return nil, err
+			}
+
+			slog.Warn("bastion unreachable, trying the next one", "instance", bastionEndpoint.InstanceID, "err", err)
+			next, err := newBastion(candidates[0])
+			if err != nil {
+				return nil, err
+			}
+			candidates = candidates[1:]
+			bastionEndpoint = next
+			if ttl > 0 {
+				setCachedBastion(key, bastionEndpoint.InstanceID, ttl)
+			}
+		}
 	}
 
-	for _, ep := range c.Args().Slice() {
-		destEndpoint, err := sshutils.NewEC2Endpoint(c.Context, ep, ec2Client, connectClient)
+	newDestination := func(ep string) (sshutils.EndpointIface, error) {
+		// IP destinations are reached directly through the chain without any EC2 lookup
+		addr, options, _ := strings.Cut(ep, ",")
+		if direct := sshutils.NewEndpoint(addr); net.ParseIP(direct.Host) != nil {
+			user, port := sshCfg.defaults(direct.Host)
+			if direct.User == "" {
+				direct.User = "ec2-user"
+				if user != "" {
+					direct.User = user
+				}
+			}
+			if port != 0 && !hasPort(addr) {
+				direct.Port = port
+			}
+			direct.ClientOptions = clientOpts
+
+			settings, err := sshutils.ParseEndpointOptions(options)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range settings {
+				if k != "hostkey" {
+					return nil, fmt.Errorf("destination option %s can't be used with an IP address, only hostkey can", k)
+				}
+				direct.HostKeyFingerprint = v
+			}
+			return direct, nil
+		}
+
+		ctx, cancel := withTimeout(c.Context, awsTimeout)
+		defer cancel()
+		ep, err := resolveTagDestination(ctx, clients, ep, order)
 		if err != nil {
-			return err
+			return nil, timeoutError(err, awsTimeout)
+		}
+
+		destEndpoint, err := sshutils.NewEC2Endpoint(ctx, ep, ec2Client, connectClient, endpointOpts...)
+		if err != nil {
+			return nil, timeoutError(err, awsTimeout)
 		}
 		destEndpoint.UsePrivate = true
-		chain = append(chain, destEndpoint)
+		destEndpoint.PreferIPv6 = c.Bool("prefer-ipv6") || c.String("address-family") == "inet6"
+
+		user, port := sshCfg.defaults(destEndpoint.InstanceID, destEndpoint.Host())
+		spec, _, _ := strings.Cut(ep, ",")
+		if user != "" && !strings.Contains(spec, "@") {
+			destEndpoint.User = user
+		}
+		if port != 0 && !hasPort(spec) {
+			destEndpoint.Port = port
+		}
+		return destEndpoint, nil
+	}
+
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return errors.New("--concurrency must be at least 1")
+	}
+
+	destinations, err := resolveDestinations(args, newDestination, concurrency)
+	if err != nil {
+		return err
+	}
+
+	// each host in the file is reached on its own through the bastion
+	var hosts []sshutils.EndpointIface
+	if path := c.String("hosts-file"); path != "" {
+		lines, err := readHostsFile(path)
+		if err != nil {
+			return err
+		}
+		if hosts, err = resolveDestinations(lines, newDestination, concurrency); err != nil {
+			return err
+		}
+	}
+
+	// last is the host the shell and forwards end up on
+	var last sshutils.EndpointIface = bastionEndpoint
+	if len(destinations) > 0 {
+		last = destinations[len(destinations)-1]
+	}
+
+	if eni := c.String("network-interface"); eni != "" {
+		ec2Endpoint, ok := last.(*sshutils.EC2Endpoint)
+		if !ok {
+			return errors.New("--network-interface can only be used when the last destination is an instance")
+		}
+		if err := ec2Endpoint.SelectNetworkInterface(eni); err != nil {
+			return err
+		}
+	}
+
+	if err := bastionEndpoint.CheckAddress(); err != nil {
+		return fmt.Errorf("bastion %w", err)
+	}
+	for _, dest := range append(destinations[:len(destinations):len(destinations)], hosts...) {
+		if ec2Endpoint, ok := dest.(*sshutils.EC2Endpoint); ok {
+			if err := ec2Endpoint.CheckAddress(); err != nil {
+				return fmt.Errorf("destination %w", err)
+			}
+		}
+	}
+
+	if bastionEndpoint.UseDNS {
+		if _, err := net.DefaultResolver.LookupHost(c.Context, bastionEndpoint.Host()); err != nil {
+			return fmt.Errorf("bastion DNS name %s does not resolve, check your VPN or DNS forwarding: %w", bastionEndpoint.Host(), err)
+		}
+	}
+
+	// an existing ControlMaster to the bastion stands in for our own first hop
+	controlPath := c.String("control-path")
+	if controlPath != "" && !sshutils.ControlSocketExists(controlPath) {
+		slog.Debug("no control socket, connecting to the bastion directly", "path", controlPath)
+		controlPath = ""
+	}
+
+	tunnels := c.StringSlice("tunnel")
+	if len(tunnels) > 1 && c.Int("local-port") != 0 {
+		return errors.New("--local-port can only be used with a single --tunnel, each tunnel listens on its remote port")
+	}
+	if c.Bool("random-port") && c.Int("local-port") != 0 {
+		return errors.New("--random-port can't be combined with --local-port")
+	}
+
+	var resolver *net.Resolver
+	switch c.String("resolve-on") {
+	case "remote":
+		if c.IsSet("resolve-on") && c.String("dns-server") != "" {
+			return errors.New("--dns-server resolves locally, it can't be combined with --resolve-on remote")
+		}
+		if c.String("dns-server") != "" {
+			resolver = sshutils.NewResolver(c.String("dns-server"))
+		}
+	case "local":
+		resolver = net.DefaultResolver
+		if c.String("dns-server") != "" {
+			resolver = sshutils.NewResolver(c.String("dns-server"))
+		}
+	default:
+		return fmt.Errorf("%s is not a valid place to resolve, use remote or local", c.String("resolve-on"))
+	}
+
+	var rateLimit int64
+	if c.String("rate-limit") != "" {
+		rateLimit, err = sshutils.ParseRate(c.String("rate-limit"))
+		if err != nil {
+			return err
+		}
+	}
+	if scope := c.String("rate-limit-scope"); scope != "connection" && scope != "aggregate" {
+		return fmt.Errorf("%s is not a valid rate limit scope, use connection or aggregate", scope)
+	}
+
+	allow, err := sshutils.ParseAllowlist(c.StringSlice("allow"))
+	if err != nil {
+		return err
+	}
+
+	var forwards []sshutils.ForwardSpec
+	for _, f := range []struct {
+		kind sshutils.ForwardKind
+		flag string
+	}{
+		{sshutils.LocalForward, "local-forward"},
+		{sshutils.RemoteForward, "remote-forward"},
+		{sshutils.DynamicForward, "dynamic-forward"},
+		{sshutils.UDPForward, "udp-forward"},
+	} {
+		for _, s := range c.StringSlice(f.flag) {
+			spec, err := sshutils.ParseForwardSpec(f.kind, s)
+			if err != nil {
+				return err
+			}
+			spec.Allow = allow
+			spec.RawDatagrams = c.Bool("udp-raw")
+			forwards = append(forwards, spec)
+		}
+	}
+	// destinations are only reached by a shell, so giving them with tunnels
+	// opens one alongside
+	shell := len(tunnels) == 0 || c.Bool("shell") || len(destinations) > 0
+	if len(forwards) > 0 && (c.Bool("exec") || !shell) {
+		return errors.New("-L, -R, -D and --udp-forward forward over the shell's connection, they can't be combined with --exec or a --tunnel without --shell")
+	}
+
+	var fwds []*sshutils.Forwarder
+	for _, t := range tunnels {
+		tunnel := sshutils.NewEndpoint(t)
+		localPort := c.Int("local-port")
+		if t == "imds" {
+			// the bastion's metadata service, so local tools can borrow its instance profile
+			tunnel = &sshutils.Endpoint{Host: imdsHost, Port: 80}
+			if localPort == 0 {
+				localPort = imdsLocalPort
+			}
+			slog.Info(fmt.Sprintf("tunnelling to the bastion's metadata service, use AWS_EC2_METADATA_SERVICE_ENDPOINT=http://localhost:%d with the AWS CLI and SDKs", localPort))
+		}
+		if localPort == 0 && !c.Bool("random-port") {
+			localPort = tunnel.Port
+		}
+
+		fwds = append(fwds, &sshutils.Forwarder{
+			LocalPort:          localPort,
+			Remote:             tunnel,
+			ProxyProtocol:      c.Bool("proxy-protocol"),
+			RateLimit:          rateLimit,
+			AggregateRateLimit: c.String("rate-limit-scope") == "aggregate",
+			Heartbeat:          c.Duration("heartbeat"),
+			Allow:              allow,
+			ControlPath:        controlPath,
+			Resolver:           resolver,
+		})
+	}
+
+	if c.Bool("dry-run") {
+		printPlan(os.Stdout, bastionEndpoint, destinations, fwds, shell)
+		return nil
+	}
+
+	if c.Bool("transport-only") {
+		return sshutils.Pipe(bastionEndpoint.Address())
+	}
+
+	if command := c.String("command"); command != "" {
+		chains := [][]sshutils.EndpointIface{destinations}
+		if hosts != nil {
+			chains = nil
+			for _, host := range hosts {
+				chains = append(chains, []sshutils.EndpointIface{host})
+			}
+		}
+
+		// a single host's output is left as it is, as ssh would
+		prefix := c.String("output-prefix")
+		if prefix == "" {
+			prefix = "id"
+			if len(chains) == 1 {
+				prefix = "none"
+			}
+		}
+
+		client, err := dialBastion()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return runOnHosts(client, chains, command, concurrency, &hostOutput{
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+			Prefix: prefix,
+			Buffer: c.Bool("buffer-output"),
+		})
+	}
+
+	logStatsOnSignal(fwds)
+
+	// on exit, including an interrupt, connections are given time to finish
+	addCleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Duration("drain-timeout"))
+		defer cancel()
+		for _, fwd := range fwds {
+			if err := fwd.Shutdown(ctx); err != nil {
+				slog.Warn(err.Error())
+			}
+		}
+	})
+
+	// openTunnels connects to the bastion before listening, so that a bastion
+	// that can't be reached fails straight away and ready means truly ready.
+	// Every tunnel shares client, which is dialled when it's nil.
+	readyFD := c.Int("ready-fd")
+	openTunnels := func(client *sshutils.SharedClient) ([]net.Listener, error) {
+		if client == nil && controlPath == "" {
+			bastion, err := dialBastion()
+			if err != nil {
+				return nil, fmt.Errorf("unable to connect to the bastion: %w", err)
+			}
+			client = sshutils.NewSharedClient(bastion, dialBastion)
+			slog.Info("connected via " + sshutils.Path(bastion))
+			if c.Bool("show-instance-info") {
+				printInstanceInfo(os.Stderr, bastionEndpoint)
+			}
+		}
+
+		var listeners []net.Listener
+		closeAll := func() {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}
+		for _, fwd := range fwds {
+			fwd.Bastion = bastionEndpoint
+			fwd.Client = client
+			listener, err := fwd.Listen()
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+			if url := connectionURL(fwd); url != "" {
+				slog.Info("tunnel open, connect with", "url", url)
+			}
+		}
+
+		if err := signalReady(listeners, readyFD); err != nil {
+			closeAll()
+			return nil, err
+		}
+		return listeners, nil
+	}
+
+	// serveTunnels serves each tunnel in the background, once the listeners
+	// are closed they stop
+	serveTunnels := func(listeners []net.Listener) {
+		for i, listener := range listeners {
+			go func(fwd *sshutils.Forwarder, listener net.Listener) {
+				if err := fwd.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+					slog.Error("tunnel error", "err", err)
+				}
+			}(fwds[i], listener)
+		}
+	}
+
+	if c.Bool("exec") {
+		if len(fwds) > 0 {
+			// the listeners are open once openTunnels returns, so the command
+			// can connect straight away, closing them afterwards shuts the tunnels
+			listeners, err := openTunnels(nil)
+			if err != nil {
+				return err
+			}
+			for _, listener := range listeners {
+				defer listener.Close()
+			}
+			serveTunnels(listeners)
+		}
+		return runCommand(command, execEnv(cfg.Region, bastionEndpoint, fwds))
+	}
+
+	if !shell {
+		listeners, err := openTunnels(nil)
+		if err != nil {
+			return err
+		}
+		serveTunnels(listeners[1:])
+		return fwds[0].Serve(listeners[0])
+	}
+
+	var client *ssh.Client
+	if controlPath != "" && len(destinations) > 0 {
+		client, err = sshutils.DialFromControl(controlPath, destinations...)
+		destinations = nil
+	} else {
+		client, err = dialBastion()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(fwds) > 0 {
+		// the tunnels share the shell's connection to the bastion, which is
+		// reconnected for all of them when it's lost. With a control socket
+		// they go through it instead.
+		var shared *sshutils.SharedClient
+		if controlPath == "" {
+			shared = sshutils.NewSharedClient(client, dialBastion)
+		}
+		listeners, err := openTunnels(shared)
+		if err != nil {
+			return err
+		}
+		serveTunnels(listeners)
+	}
+
+	client, err = sshutils.DialFrom(client, destinations...)
+	if err != nil {
+		return err
+	}
+	slog.Info("connected via " + sshutils.Path(client))
+	if c.Bool("show-instance-info") {
+		printInstanceInfo(os.Stderr, last)
+	}
+
+	for _, spec := range forwards {
+		listener, err := spec.Start(client)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+	}
+
+	if c.Bool("no-shell") {
+		// forward until the connection is closed, or interrupted
+		return client.Wait()
+	}
+	if message := c.String("require-ack"); message != "" {
+		if err := requireAck(message, os.Stdin, os.Stderr); err != nil {
+			return err
+		}
+	}
+	shellOpts := sshutils.ShellOptions{Escapes: !c.Bool("no-escapes"), Allow: allow}
+	if c.Bool("no-pty") {
+		shellOpts.Pty = sshutils.PtyNever
+	} else if c.Bool("force-pty") {
+		shellOpts.Pty = sshutils.PtyForce
+	}
+	if path := c.String("record"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to create recording: %w", err)
+		}
+		defer f.Close()
+		shellOpts.Recorder = sshutils.NewRecorder(f)
 	}
+	if path := c.String("audit-input"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to open input audit log: %w", err)
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "\n# amz-ssh session via %s at %s\n", sshutils.Path(client), time.Now().Format(time.RFC3339))
+		slog.Warn("everything typed into this session, including passwords, is written to " + path)
+		shellOpts.InputAudit = f
+	}
+	return sshutils.ShellWithOptions(client, shellOpts)
+}
+
+// imdsHost is the instance metadata service, --tunnel imds forwards imdsLocalPort
+// to it as the usual port 80 needs root to listen on
+const (
+	imdsHost      = "169.254.169.254"
+	imdsLocalPort = 8169
+)
+
+// dialTimeout bounds connecting to a bastion, so that an unreachable one
+// fails over to the next candidate rather than waiting on the OS timeout
+const dialTimeout = 20 * time.Second
+
+// resolveDestinations creates the destination endpoints concurrently so their
+// AWS calls and key generation overlap, keeping the order they were given in.
+// At most concurrency are looked up at once, to stay clear of API throttling.
+func resolveDestinations(args []string, newEndpoint func(string) (sshutils.EndpointIface, error), concurrency int) ([]sshutils.EndpointIface, error) {
+	destinations := make([]sshutils.EndpointIface, len(args))
+	errs := make([]error, len(args))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, arg := range args {
+		wg.Add(1)
+		go func(i int, arg string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			destinations[i], errs[i] = newEndpoint(arg)
+		}(i, arg)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return destinations, nil
+}
+
+// printPlan describes what a connection would do, it must not call String()
+// on EC2 endpoints as that pushes the public key
+func printPlan(w io.Writer, bastion *sshutils.EC2Endpoint, destinations []sshutils.EndpointIface, tunnels []*sshutils.Forwarder, shell bool) {
+	fmt.Fprintf(w, "bastion:     %s\n", describeEndpoint(bastion))
+	for _, dest := range destinations {
+		fmt.Fprintf(w, "destination: %s\n", describeEndpoint(dest))
+	}
+
+	for _, tunnel := range tunnels {
+		local := fmt.Sprint(tunnel.LocalPort)
+		if tunnel.LocalPort == 0 {
+			local = "(random)"
+		}
+		fmt.Fprintf(w, "tunnel:      localhost:%s -> %s via bastion\n", local, tunnel.Remote.String())
+	}
+	if shell {
+		var last sshutils.EndpointIface = bastion
+		if len(destinations) > 0 {
+			last = destinations[len(destinations)-1]
+		}
+		fmt.Fprintf(w, "shell:       %s\n", describeEndpoint(last))
+	}
+}
+
+// signalReady reports that the tunnels are accepting connections, as log lines
+// and for scripts as a READY line per tunnel on the fd given by --ready-fd
+func signalReady(listeners []net.Listener, fd int) error {
+	for _, listener := range listeners {
+		slog.Info("ready", "addr", listener.Addr().String())
+	}
+	if fd <= 0 {
+		return nil
+	}
+
+	f := os.NewFile(uintptr(fd), "ready-fd")
+	if f == nil {
+		return fmt.Errorf("%d is not a valid --ready-fd", fd)
+	}
+	defer f.Close()
+	for _, listener := range listeners {
+		if _, err := fmt.Fprintf(f, "READY %s\n", listener.Addr()); err != nil {
+			return fmt.Errorf("unable to signal readiness on fd %d: %w", fd, err)
+		}
+	}
+	return nil
+}
 
-	return sshutils.Connect(chain...)
+// serviceSchemes are the URL schemes of the services usually found on a port,
+// for suggesting how to connect to a tunnel
+var serviceSchemes = map[int]string{
+	80:    "http",
+	443:   "https",
+	1433:  "sqlserver",
+	3306:  "mysql",
+	5432:  "postgres",
+	6379:  "redis",
+	9200:  "http",
+	27017: "mongodb",
 }
 
-func getSpotRequestByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
-	return ec2Client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+// connectionURL returns a URL for the local end of fwd inferred from the
+// remote port, or an empty string when the service isn't known
+func connectionURL(fwd *sshutils.Forwarder) string {
+	remote, ok := fwd.Remote.(*sshutils.Endpoint)
+	if !ok {
+		return ""
+	}
+	scheme, ok := serviceSchemes[remote.Port]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s://localhost:%d", scheme, fwd.LocalPort)
+}
+
+// hasPort reports whether a destination such as user@host:port gives a port
+func hasPort(dest string) bool {
+	_, hostPort, _ := strings.Cut(dest, "@")
+	if hostPort == "" {
+		hostPort = dest
+	}
+	_, _, err := net.SplitHostPort(hostPort)
+	return err == nil
+}
+
+// printInstanceInfo shows what the instance behind ep is, to confirm the
+// connection landed on the expected host
+func printInstanceInfo(w io.Writer, ep sshutils.EndpointIface) {
+	e, ok := ep.(*sshutils.EC2Endpoint)
+	if !ok || e.Instance == nil {
+		return
+	}
+
+	instance := *e.Instance
+	fmt.Fprintf(w, "instance:    %s\n", e.InstanceID)
+	if name := instanceName(instance); name != "" {
+		fmt.Fprintf(w, "name:        %s\n", name)
+	}
+	fmt.Fprintf(w, "type:        %s\n", instance.InstanceType)
+	if instance.Placement != nil {
+		fmt.Fprintf(w, "zone:        %s\n", aws.ToString(instance.Placement.AvailabilityZone))
+	}
+	if instance.LaunchTime != nil {
+		fmt.Fprintf(w, "launched:    %s\n", instance.LaunchTime.Format(time.RFC3339))
+	}
+}
+
+func describeEndpoint(ep sshutils.EndpointIface) string {
+	switch e := ep.(type) {
+	case *sshutils.EC2Endpoint:
+		return fmt.Sprintf("%s %s@%s", e.InstanceID, e.User, e.Address())
+	case *sshutils.Endpoint:
+		return fmt.Sprintf("%s@%s", e.User, e.String())
+	}
+	return ep.String()
+}
+
+// getSpotRequestByTag returns the fulfilled spot requests with the tag from every page of results
+func getSpotRequestByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) ([]ec2types.SpotInstanceRequest, error) {
+	var requests []ec2types.SpotInstanceRequest
+	paginator := ec2.NewDescribeSpotInstanceRequestsPaginator(ec2Client, &ec2.DescribeSpotInstanceRequestsInput{
 		Filters: []ec2types.Filter{
 			{
 				Name:   aws.String("tag:" + tagName),
@@ -170,57 +1464,253 @@ func getSpotRequestByTag(ctx context.Context, ec2Client *ec2.Client, tagName, ta
 			},
 		},
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, page.SpotInstanceRequests...)
+	}
+	return requests, nil
 }
 
-func getInstanceByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) (*ec2.DescribeInstancesOutput, error) {
-	return ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-		Filters: []ec2types.Filter{
-			{
-				Name:   aws.String("tag:" + tagName),
-				Values: []string{tagValue},
-			},
+// getInstanceByTag returns the running instances with the tag from every page of results
+func getInstanceByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) ([]ec2types.Instance, error) {
+	return getInstances(ctx, ec2Client, instanceFilters([]ec2types.Filter{
+		{
+			Name:   aws.String("tag:" + tagName),
+			Values: []string{tagValue},
+		},
+	}))
+}
+
+// withTimeout bounds AWS lookups so a hung API call fails quickly instead of
+// blocking, a timeout of 0 disables it
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError explains an AWS lookup that ran out of time
+func timeoutError(err error, timeout time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("AWS lookup timed out after %s, check your network or raise --aws-timeout: %w", timeout, err)
+	}
+	return err
+}
+
+// instanceOrder puts the instances matching a tag in the order they are tried
+type instanceOrder func(ids []string)
+
+// shuffleInstances spreads connections over all the matching instances. It
+// uses crypto/rand so the order doesn't depend on how math/rand is seeded,
+// which before Go 1.20 made every run pick the same "random" instance
+func shuffleInstances(ids []string) {
+	for i := len(ids) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			slog.Debug("unable to shuffle instances, using them in the order found", "err", err)
+			return
+		}
+		ids[i], ids[j.Int64()] = ids[j.Int64()], ids[i]
+	}
+}
+
+// sortInstances orders by instance id so that repeated runs pick the same instance
+func sortInstances(ids []string) {
+	sort.Strings(ids)
+}
+
+// launchTimeOrder orders by launch time, newest or oldest first, looking the
+// times up with ec2Client. When they can't be looked up the instances are
+// left in the order found.
+func launchTimeOrder(ctx context.Context, ec2Client *ec2.Client, newest bool) instanceOrder {
+	return func(ids []string) {
+		instances, err := getInstances(ctx, ec2Client, []ec2types.Filter{
 			{
-				Name:   aws.String("instance-state-name"),
-				Values: []string{"running"},
+				Name:   aws.String("instance-id"),
+				Values: ids,
 			},
-		},
-	})
+		})
+		if err != nil {
+			slog.Warn("unable to look up launch times, using the instances in the order found", "err", err)
+			return
+		}
+
+		launched := map[string]time.Time{}
+		for _, instance := range instances {
+			launched[aws.ToString(instance.InstanceId)] = aws.ToTime(instance.LaunchTime)
+		}
+		sort.SliceStable(ids, func(i, j int) bool {
+			if newest {
+				return launched[ids[i]].After(launched[ids[j]])
+			}
+			return launched[ids[i]].Before(launched[ids[j]])
+		})
+	}
 }
 
-func resolveBastionInstanceID(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) (string, error) {
-	slog.Debug("Looking for bastion spot request")
-	siro, err := getSpotRequestByTag(ctx, ec2Client, tagName, tagValue)
+// resolveInstanceIDByTag picks the first of the instances with the tag,
+// preferring fulfilled spot requests
+func resolveInstanceIDByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string, order instanceOrder) (string, error) {
+	ids, err := resolveInstanceIDsByTag(ctx, ec2Client, tagName, tagValue, order)
 	if err != nil {
 		return "", err
 	}
+	return ids[0], nil
+}
+
+// resolveInstanceIDsByTag returns every instance with the tag in the given
+// order, fulfilled spot requests are preferred over looking up the instances directly
+func resolveInstanceIDsByTag(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string, order instanceOrder) ([]string, error) {
+	var ids []string
+
+	slog.Debug("Looking for spot request", "tag", tagName+":"+tagValue)
+	requests, err := getSpotRequestByTag(ctx, ec2Client, tagName, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	for _, sir := range requests {
+		ids = append(ids, aws.ToString(sir.InstanceId))
+	}
+
+	if len(ids) == 0 {
+		slog.Debug("No spot requests found, looking for instance directly")
+		instances, err := getInstanceByTag(ctx, ec2Client, tagName, tagValue)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			ids = append(ids, aws.ToString(instance.InstanceId))
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("unable to find any running instances tagged %s:%s", tagName, tagValue)
+	}
+
+	order(ids)
+	return ids, nil
+}
+
+// resolveTagDestination replaces a tag:key=value destination with the id of a
+// matching instance, keeping any user, port and options, eg
+// ubuntu@tag:role=app:2222,region=eu-west-1
+func resolveTagDestination(ctx context.Context, clients *sshutils.Clients, dest string, order instanceOrder) (string, error) {
+	addr, options, _ := strings.Cut(dest, ",")
+	user, host, hasUser := strings.Cut(addr, "@")
+	if !hasUser {
+		user, host = "", addr
+	}
+
+	tag, ok := strings.CutPrefix(host, "tag:")
+	if !ok {
+		return dest, nil
+	}
+	tag, port, _ := strings.Cut(tag, ":")
+	tagName, tagValue, ok := strings.Cut(tag, "=")
+	if !ok || tagName == "" {
+		return "", fmt.Errorf("%s is not a valid tag destination, use tag:key=value", host)
+	}
 
-	if len(siro.SpotInstanceRequests) > 0 {
-		return aws.ToString(siro.SpotInstanceRequests[rand.Intn(len(siro.SpotInstanceRequests))].InstanceId), nil
+	// the lookup has to happen in the region the destination is in
+	var region string
+	for _, option := range strings.Split(options, ",") {
+		if v, ok := strings.CutPrefix(option, "region="); ok {
+			region = v
+		}
 	}
 
-	slog.Debug("No spot requests found, looking for instance directly")
-	dio, err := getInstanceByTag(ctx, ec2Client, tagName, tagValue)
+	instanceID, err := resolveInstanceIDByTag(ctx, clients.EC2(region), tagName, tagValue, order)
 	if err != nil {
 		return "", err
 	}
+	slog.Debug(fmt.Sprintf("Resolved %s to %s", host, instanceID))
+
+	resolved := instanceID
+	if hasUser {
+		resolved = user + "@" + resolved
+	}
+	if port != "" {
+		resolved += ":" + port
+	}
+	if options != "" {
+		resolved += "," + options
+	}
+	return resolved, nil
+}
 
-	if len(dio.Reservations) > 0 {
-		res := dio.Reservations[rand.Intn(len(dio.Reservations))]
-		return aws.ToString(res.Instances[rand.Intn(len(res.Instances))].InstanceId), nil
+// keyComment expands the {identity} and {timestamp} placeholders of the key
+// comment template, so that pushed keys can be traced back to the caller
+func keyComment(ctx context.Context, cfg aws.Config, template string) (string, error) {
+	comment := strings.ReplaceAll(template, "{timestamp}", time.Now().UTC().Format(time.RFC3339))
+	if !strings.Contains(comment, "{identity}") {
+		return comment, nil
 	}
 
-	return "", errors.New("unable to find any valid bastion instances")
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get caller identity for key comment: %w", err)
+	}
+	return strings.ReplaceAll(comment, "{identity}", aws.ToString(out.Arn)), nil
 }
 
-func getClients(ctx context.Context, region string) (*ec2.Client, *connect.Client) {
+func loadConfig(ctx context.Context, region string, ssoLogin, trace bool) (aws.Config, error) {
 	var opts []func(*config.LoadOptions) error
 	if region != "" {
 		opts = append(opts, config.WithRegion(region))
 	}
+	if trace {
+		opts = append(opts,
+			config.WithLogger(awsLogger{}),
+			config.WithClientLogMode(aws.LogRequest|aws.LogResponseWithBody|aws.LogRetries),
+		)
+	}
 	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		slog.Error("unable to load SDK config", "err", err)
-		os.Exit(1)
+		return cfg, fmt.Errorf("unable to load SDK config: %w", err)
 	}
-	return ec2.NewFromConfig(cfg), connect.NewFromConfig(cfg)
+
+	if err := checkCredentials(ctx, cfg, ssoLogin); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// checkCredentials retrieves the credentials up front so that an expired SSO
+// session is reported with a useful hint instead of an opaque error from the first API call
+func checkCredentials(ctx context.Context, cfg aws.Config, ssoLogin bool) error {
+	if cfg.Credentials == nil {
+		return nil
+	}
+
+	_, err := cfg.Credentials.Retrieve(ctx)
+	var ite *ssocreds.InvalidTokenError
+	if err == nil || !errors.As(err, &ite) {
+		return err
+	}
+
+	args := []string{"sso", "login"}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		args = append(args, "--profile", profile)
+	}
+
+	if !ssoLogin {
+		return fmt.Errorf("SSO session has expired, run `aws %s` or use --sso-login: %w", strings.Join(args, " "), err)
+	}
+
+	slog.Info("SSO session has expired, running aws " + strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("aws sso login failed: %w", err)
+	}
+
+	_, err = cfg.Credentials.Retrieve(ctx)
+	return err
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+func TestCleanupRunsWhenPushFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-ErrorType", "EC2InstanceNotFoundException")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"Message":"instance not found"}`)
+	}))
+	defer srv.Close()
+
+	privateKey, publicKey, err := sshutils.GenerateKeyPair(sshutils.KeyTypeED25519, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastion := &sshutils.EC2Endpoint{
+		InstanceID: "i-0123456789abcdef0",
+		Port:       22,
+		User:       "ec2-user",
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Instance: &ec2types.Instance{
+			InstanceId:      aws.String("i-0123456789abcdef0"),
+			PublicIpAddress: aws.String("192.0.2.1"),
+			Placement:       &ec2types.Placement{AvailabilityZone: aws.String("eu-west-1a")},
+		},
+		ConnectClient: ec2instanceconnect.New(ec2instanceconnect.Options{
+			Region:           "eu-west-1",
+			Credentials:      aws.AnonymousCredentials{},
+			EndpointResolver: ec2instanceconnect.EndpointResolverFromURL(srv.URL),
+			Retryer:          aws.NopRetryer{},
+		}),
+	}
+
+	var cleanedUp bool
+	addCleanup(func() { cleanedUp = true })
+
+	_, err = sshutils.Dial(bastion)
+	if err == nil {
+		t.Fatal("expected the dial to fail when the key can't be pushed")
+	}
+	if status := exitStatus(err); status != 1 {
+		t.Errorf("exit status = %d, want 1", status)
+	}
+	if !cleanedUp {
+		t.Error("cleanup didn't run after the push failed")
+	}
+}
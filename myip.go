@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// checkIPURL returns the caller's public IP as AWS sees it
+const checkIPURL = "https://checkip.amazonaws.com"
+
+// publicIP looks up the address connections from this machine appear to come
+// from, which is what security group rules have to allow
+func publicIP(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkIPURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to look up public IP: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to look up public IP: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("unexpected public IP response %q", ip)
+	}
+	return ip, nil
+}
+
+// reportSourceIP logs the local address of the bastion connection and the
+// public IP it's seen as, to help with security group rules
+func reportSourceIP(ctx context.Context, client *ssh.Client) {
+	local := client.LocalAddr().String()
+	if host, _, err := net.SplitHostPort(local); err == nil {
+		local = host
+	}
+
+	ip, err := publicIP(ctx)
+	if err != nil {
+		slog.Warn(err.Error())
+		ip = "unknown"
+	}
+	slog.Info(fmt.Sprintf("connected to the bastion from %s, seen by AWS as %s", local, ip))
+}
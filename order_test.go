@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// fakeEC2Client answers DescribeInstances with instances launched at the
+// given times, and has no spot requests
+func fakeEC2Client(t *testing.T, launched map[string]string) *ec2.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		switch action := r.Form.Get("Action"); action {
+		case "DescribeSpotInstanceRequests":
+			fmt.Fprint(w, `<DescribeSpotInstanceRequestsResponse><spotInstanceRequestSet/></DescribeSpotInstanceRequestsResponse>`)
+		case "DescribeInstances":
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>`)
+			for id, launchTime := range launched {
+				fmt.Fprintf(w, `<item><instanceId>%s</instanceId><launchTime>%s</launchTime></item>`, id, launchTime)
+			}
+			fmt.Fprint(w, `</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+		default:
+			t.Errorf("unexpected %s call", action)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return ec2.New(ec2.Options{
+		Region:           "eu-west-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: ec2.EndpointResolverFromURL(srv.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+}
+
+func TestResolveInstanceIDsByTagOrder(t *testing.T) {
+	ctx := context.Background()
+	client := fakeEC2Client(t, map[string]string{
+		"i-0b": "2023-03-01T00:00:00.000Z",
+		"i-0a": "2023-02-01T00:00:00.000Z",
+		"i-0c": "2023-01-01T00:00:00.000Z",
+	})
+
+	tests := []struct {
+		name  string
+		order instanceOrder
+		want  []string
+	}{
+		{"first", sortInstances, []string{"i-0a", "i-0b", "i-0c"}},
+		{"newest", launchTimeOrder(ctx, client, true), []string{"i-0b", "i-0a", "i-0c"}},
+		{"oldest", launchTimeOrder(ctx, client, false), []string{"i-0c", "i-0a", "i-0b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveInstanceIDsByTag(ctx, client, "role", "bastion", tt.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShuffleInstancesKeepsInstances(t *testing.T) {
+	ids := []string{"i-0a", "i-0b", "i-0c", "i-0d"}
+	shuffleInstances(ids)
+	sortInstances(ids)
+	if want := []string{"i-0a", "i-0b", "i-0c", "i-0d"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("shuffling changed the instances to %v", ids)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// pickerPageSize is how many matches are listed at once
+const pickerPageSize = 20
+
+// pickable is a running instance as shown in the --pick list
+type pickable struct {
+	id    string
+	label string
+}
+
+// listRunningInstances returns every running instance, following all pages of results
+func listRunningInstances(ctx context.Context, ec2Client *ec2.Client) ([]pickable, error) {
+	var instances []pickable
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"running"},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range page.Reservations {
+			for _, instance := range res.Instances {
+				instances = append(instances, pickable{
+					id:    aws.ToString(instance.InstanceId),
+					label: instanceLabel(instance),
+				})
+			}
+		}
+	}
+	return instances, nil
+}
+
+func instanceLabel(instance ec2types.Instance) string {
+	return fmt.Sprintf("%-20s %-30s %-15s %s", aws.ToString(instance.InstanceId), instanceName(instance),
+		aws.ToString(instance.PrivateIpAddress), instance.InstanceType)
+}
+
+// instanceName returns the instance's Name tag, or an empty string without one
+func instanceName(instance ec2types.Instance) string {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// pickInstance lets the user narrow the instances down with a fuzzy filter
+// and choose one by its number, returning its id
+func pickInstance(instances []pickable, in io.Reader, out io.Writer) (string, error) {
+	if len(instances) == 0 {
+		return "", errors.New("no running instances to pick from")
+	}
+
+	matches := instances
+	for {
+		for i, p := range matches {
+			if i == pickerPageSize {
+				fmt.Fprintf(out, "  ... %d more, type to filter\n", len(matches)-pickerPageSize)
+				break
+			}
+			fmt.Fprintf(out, "%3d) %s\n", i+1, p.label)
+		}
+		fmt.Fprint(out, "filter or number> ")
+
+		// read only the answer, the rest of in is for the remote shell
+		line, err := sshutils.ReadLine(in)
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			if errors.Is(err, io.EOF) {
+				return "", errors.New("no instance picked")
+			}
+			return "", err
+		}
+		input := strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(matches) && n <= pickerPageSize {
+			return matches[n-1].id, nil
+		}
+		if input == "" && len(matches) == 1 {
+			return matches[0].id, nil
+		}
+
+		filtered := fuzzyFilter(instances, input)
+		if len(filtered) == 0 {
+			fmt.Fprintf(out, "nothing matches %q\n", input)
+			continue
+		}
+		matches = filtered
+	}
+}
+
+// fuzzyFilter keeps the instances whose label contains the letters of the
+// filter in order, ignoring case and spaces, eg "wbprd" matches "web-prod"
+func fuzzyFilter(instances []pickable, filter string) []pickable {
+	needle := []rune(strings.ToLower(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, filter)))
+
+	var matches []pickable
+	for _, p := range instances {
+		i := 0
+		for _, r := range strings.ToLower(p.label) {
+			if i < len(needle) && r == needle[i] {
+				i++
+			}
+		}
+		if i == len(needle) {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
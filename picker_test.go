@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPickInstanceLeavesInput(t *testing.T) {
+	instances := []pickable{
+		{id: "i-0eaa4d1c7f350216e", label: "i-0eaa4d1c7f350216e web-prod"},
+		{id: "i-0b22a22eec53b9321", label: "i-0b22a22eec53b9321 db-prod"},
+	}
+	in := strings.NewReader("9321\n\nuptime\n")
+	id, err := pickInstance(instances, in, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "i-0b22a22eec53b9321" {
+		t.Errorf("picked %s, want i-0b22a22eec53b9321", id)
+	}
+	rest, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "uptime\n" {
+		t.Errorf("input after the answer = %q, want %q", rest, "uptime\n")
+	}
+}
+
+func TestPickInstanceNoAnswer(t *testing.T) {
+	instances := []pickable{{id: "i-0eaa4d1c7f350216e", label: "i-0eaa4d1c7f350216e web-prod"}}
+	if _, err := pickInstance(instances, strings.NewReader(""), io.Discard); err == nil {
+		t.Error("picked an instance without an answer")
+	}
+	// a last line without a newline is still an answer
+	if id, err := pickInstance(instances, strings.NewReader("1"), io.Discard); err != nil || id != "i-0eaa4d1c7f350216e" {
+		t.Errorf("pickInstance() = %q, %v, want i-0eaa4d1c7f350216e", id, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// ping checks the bastion, and any destinations after it, can be connected to
+// by running true there, for monitoring. It prints how long that took and
+// each phase of it, so that latency can be tracked, and fails if it can't.
+func ping(c *cli.Context) error {
+	if err := c.Set("command", "true"); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := connect(c, c.Args().Slice())
+	took := time.Since(start).Round(time.Millisecond)
+
+	var phases []string
+	for _, t := range sshutils.Timings() {
+		phases = append(phases, fmt.Sprintf("%s %s", t.Phase, t.Duration.Round(time.Millisecond)))
+	}
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	if len(phases) > 0 {
+		fmt.Fprintf(c.App.Writer, "%s in %s (%s)\n", status, took, strings.Join(phases, ", "))
+	} else {
+		fmt.Fprintf(c.App.Writer, "%s in %s\n", status, took)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package sshutils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// allowRule matches forwarding targets by CIDR, IP or hostname, with an
+// optional port
+type allowRule struct {
+	network *net.IPNet
+	host    string
+	port    int
+}
+
+// Allowlist restricts where tunnels and the SOCKS proxy may connect to, so
+// they can't be used as an open proxy into the VPC. An empty list allows everything.
+type Allowlist []allowRule
+
+// ParseAllowlist parses patterns of the form target[:port], where target is a
+// CIDR, an IP, a hostname or a *.domain wildcard, eg 10.0.0.0/16:5432 or
+// *.rds.amazonaws.com. IPv6 targets with a port are given in brackets.
+func ParseAllowlist(patterns []string) (Allowlist, error) {
+	var allow Allowlist
+	for _, pattern := range patterns {
+		target, port := pattern, ""
+		if host, p, err := net.SplitHostPort(pattern); err == nil {
+			target, port = host, p
+		}
+
+		rule := allowRule{}
+		if port != "" && port != "*" {
+			n, err := strconv.Atoi(port)
+			if err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("%s is not a valid allow pattern, the port must be a number", pattern)
+			}
+			rule.port = n
+		}
+
+		switch {
+		case strings.Contains(target, "/"):
+			_, network, err := net.ParseCIDR(target)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid allow pattern: %w", pattern, err)
+			}
+			rule.network = network
+		case net.ParseIP(target) != nil:
+			ip := net.ParseIP(target)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		case target != "":
+			rule.host = strings.ToLower(target)
+		default:
+			return nil, fmt.Errorf("%s is not a valid allow pattern", pattern)
+		}
+		allow = append(allow, rule)
+	}
+	return allow, nil
+}
+
+// Allows reports whether host:port may be connected to. Hostnames are only
+// matched against hostname patterns, they aren't resolved as that happens on
+// the far side of the connection.
+func (a Allowlist) Allows(host string, port int) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	host = strings.ToLower(host)
+	for _, rule := range a {
+		if rule.port != 0 && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.network != nil:
+			if ip != nil && rule.network.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(rule.host, "*."):
+			if strings.HasSuffix(host, rule.host[1:]) {
+				return true
+			}
+		case rule.host == host:
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAddr is Allows for a host:port address
+func (a Allowlist) AllowsAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	return a.Allows(host, n)
+}
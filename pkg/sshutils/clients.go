@@ -0,0 +1,82 @@
+package sshutils
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	connect "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+)
+
+// Clients creates AWS service clients per region on demand, so that endpoints
+// in a different region to the bastion talk to the right regional APIs
+type Clients struct {
+	cfg aws.Config
+
+	mu      sync.Mutex
+	ec2     map[string]*ec2.Client
+	connect map[string]*connect.Client
+}
+
+func NewClients(cfg aws.Config) *Clients {
+	return &Clients{
+		cfg:     cfg,
+		ec2:     map[string]*ec2.Client{},
+		connect: map[string]*connect.Client{},
+	}
+}
+
+// Region is the region clients are created for when none is given
+func (c *Clients) Region() string {
+	return c.cfg.Region
+}
+
+func (c *Clients) EC2(region string) *ec2.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if region == "" {
+		region = c.cfg.Region
+	}
+	if client, ok := c.ec2[region]; ok {
+		return client
+	}
+	client := ec2.NewFromConfig(c.cfg, func(o *ec2.Options) {
+		o.Region = region
+	})
+	c.ec2[region] = client
+	return client
+}
+
+func (c *Clients) Connect(region string) *connect.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if region == "" {
+		region = c.cfg.Region
+	}
+	if client, ok := c.connect[region]; ok {
+		return client
+	}
+	client := connect.NewFromConfig(c.cfg, func(o *connect.Options) {
+		o.Region = region
+	})
+	c.connect[region] = client
+	return client
+}
+
+// regionFromAZ returns the region an availability zone belongs to, eg eu-west-1a
+// is in eu-west-1. Local Zones and Wavelength Zones carry more after the
+// region, such as us-west-2-lax-1a or us-east-1-wl1-bos-wlz-1, so the region
+// ends at the first part starting with a number, after at least two others.
+func regionFromAZ(az string) string {
+	parts := strings.Split(az, "-")
+	for i, part := range parts {
+		if i >= 2 && part != "" && part[0] >= '0' && part[0] <= '9' {
+			parts[i] = strings.TrimRight(part, "abcdefghijklmnopqrstuvwxyz")
+			return strings.Join(parts[:i+1], "-")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+package sshutils
+
+import "testing"
+
+func TestRegionFromAZ(t *testing.T) {
+	tests := []struct {
+		az   string
+		want string
+	}{
+		{"eu-west-1a", "eu-west-1"},
+		{"us-east-1f", "us-east-1"},
+		{"us-west-2-lax-1a", "us-west-2"},
+		{"us-east-1-wl1-bos-wlz-1", "us-east-1"},
+		{"", ""},
+		{"eu-west", ""},
+		{"not an az", ""},
+		{"-", ""},
+		{"1a", ""},
+		{"eu-1a", ""},
+		{"us-gov-west-1a", "us-gov-west-1"},
+	}
+	for _, tt := range tests {
+		if got := regionFromAZ(tt.az); got != tt.want {
+			t.Errorf("regionFromAZ(%q) = %q, want %q", tt.az, got, tt.want)
+		}
+	}
+}
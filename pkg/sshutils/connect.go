@@ -1,10 +1,16 @@
 package sshutils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
@@ -12,83 +18,547 @@ import (
 )
 
 func Tunnel(localPort int, remoteHost EndpointIface, bastionHost EndpointIface) error {
+	f := &Forwarder{
+		LocalPort: localPort,
+		Remote:    remoteHost,
+		Bastion:   bastionHost,
+	}
+	return f.ListenAndServe()
+}
+
+// Forwarder forwards connections accepted on LocalPort to Remote.
+// When Client is set every connection is carried over that established client,
+// otherwise a new connection to Bastion is dialled for each local connection.
+// ListenAndServe connects to Bastion up front so that a single client is shared.
+type Forwarder struct {
+	LocalPort int
+	Remote    EndpointIface
+	Bastion   EndpointIface
+	// Client is the bastion connection shared with the other Forwarders and
+	// the shell, when it's nil each connection dials Bastion
+	Client *SharedClient
+	// ProxyProtocol prepends a PROXY protocol v2 header with the local
+	// client's address to each forwarded connection
+	ProxyProtocol bool
+	// RateLimit caps the throughput of each connection in bytes per second, 0 is unlimited
+	RateLimit int64
+	// AggregateRateLimit applies RateLimit across all connections rather than to each one
+	AggregateRateLimit bool
+	// Heartbeat logs the tunnel status at this interval and checks the shared
+	// client is still alive, reconnecting it when it isn't, 0 disables it
+	Heartbeat time.Duration
+	// Allow restricts what Remote may be
+	Allow Allowlist
+	// ControlPath is an OpenSSH ControlMaster socket to the bastion, when set
+	// each connection is dialled through it instead of through Bastion or Client
+	ControlPath string
+	// Resolver resolves Remote's host name here before it's dialled, when
+	// it's nil the name is sent on for the far end to resolve
+	Resolver *net.Resolver
+
+	mu          sync.Mutex
+	active      atomic.Int64
+	transferred atomic.Int64
+	limiterOnce sync.Once
+	limiter     *RateLimiter
+
+	// listeners and conns are tracked so that Shutdown can drain them,
+	// closing is set once it has started and no more are taken on
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	closing   bool
+}
+
+func (f *Forwarder) Listen() (net.Listener, error) {
 	slog.Debug("Opening tunnel")
+	if remote := f.Remote.String(); !f.Allow.AllowsAddr(remote) {
+		return nil, fmt.Errorf("tunnelling to %s is not allowed by --allow", remote)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", f.LocalPort))
+	if err != nil {
+		return nil, err
+	}
+	// a LocalPort of 0 lets the OS pick a free port, which is then recorded
+	if f.LocalPort == 0 {
+		f.LocalPort = listener.Addr().(*net.TCPAddr).Port
+	}
+	slog.Info(fmt.Sprintf("listening on %v", listener.Addr().(*net.TCPAddr)))
+	return listener, nil
+}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", localPort))
+// Connect dials Bastion and shares that connection between all forwarded
+// connections, so a bastion that can't be reached is found straight away
+func (f *Forwarder) Connect() error {
+	if f.Bastion == nil {
+		return errors.New("no bastion to connect to")
+	}
+
+	client, err := Dial(f.Bastion)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the bastion: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Client = NewSharedClient(client, func() (*ssh.Client, error) {
+		return Dial(f.Bastion)
+	})
+	return nil
+}
+
+func (f *Forwarder) ListenAndServe() error {
+	if f.sharedClient() == nil {
+		if err := f.Connect(); err != nil {
+			return err
+		}
+	}
+
+	listener, err := f.Listen()
 	if err != nil {
 		return err
 	}
+	return f.Serve(listener)
+}
+
+func (f *Forwarder) Serve(listener net.Listener) error {
 	defer listener.Close()
-	slog.Info(fmt.Sprintf("listening on %v", listener.Addr().(*net.TCPAddr)))
+	f.mu.Lock()
+	if f.closing {
+		f.mu.Unlock()
+		return net.ErrClosed
+	}
+	f.listeners = append(f.listeners, listener)
+	f.mu.Unlock()
+
+	if f.Heartbeat > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go f.heartbeat(done)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
 		slog.Debug("accepted connection")
-		go forward(remoteHost, bastionHost, conn)
+		if f.track(conn, true) {
+			go f.forward(conn)
+		}
 	}
 }
 
-func forward(remoteHost, bastionEndpoint EndpointIface, localConn net.Conn) {
-	sshConfig, err := bastionEndpoint.GetSSHConfig()
-	if err != nil {
-		slog.Error(err.Error())
+// track adds or removes a connection being forwarded. Once Shutdown has
+// started connections aren't added, they're closed and false is returned.
+func (f *Forwarder) track(conn net.Conn, add bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if add {
+		if f.closing {
+			conn.Close()
+			return false
+		}
+		if f.conns == nil {
+			f.conns = map[net.Conn]struct{}{}
+		}
+		f.conns[conn] = struct{}{}
+		f.wg.Add(1)
+	} else {
+		delete(f.conns, conn)
+		f.wg.Done()
 	}
+	return true
+}
 
-	serverConn, err := ssh.Dial("tcp", bastionEndpoint.String(), sshConfig)
-	if err != nil {
-		slog.Error("server dial error", "err", err)
-		return
+// Shutdown stops accepting connections and waits for the active ones to
+// finish, so that in-progress transfers aren't cut off. Connections still
+// active when ctx is done are closed.
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	// set before waiting so that Serve can't add to wg while it's waited on
+	f.closing = true
+	for _, listener := range f.listeners {
+		listener.Close()
 	}
-	slog.Debug(fmt.Sprintf("connected to %s (1 of 2)", bastionEndpoint.String()))
+	f.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
 
-	remoteConn, err := serverConn.Dial("tcp", remoteHost.String())
+	if n := f.active.Load(); n > 0 {
+		slog.Info(fmt.Sprintf("waiting for %d active connections to finish", n))
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	return fmt.Errorf("closed %d connections that were still active", len(f.conns))
+}
+
+// sharedClient returns the established client, or nil when dialling per connection
+func (f *Forwarder) sharedClient() *ssh.Client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Client == nil {
+		return nil
+	}
+	return f.Client.Client()
+}
+
+func (f *Forwarder) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(f.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		status := "bastion dialled per connection"
+		f.mu.Lock()
+		shared := f.Client
+		f.mu.Unlock()
+		if shared != nil {
+			status = "bastion OK"
+			reconnected, err := shared.Check()
+			switch {
+			case err != nil:
+				slog.Error("bastion reconnect failed", "err", err)
+				status = "bastion down"
+			case reconnected:
+				status = "bastion reconnected"
+			}
+		}
+		slog.Info(fmt.Sprintf("tunnel healthy, %d active connections, %s", f.active.Load(), status))
+	}
+}
+
+func (f *Forwarder) forward(localConn net.Conn) {
+	f.active.Add(1)
+	defer f.active.Add(-1)
+	defer f.track(localConn, false)
+	defer localConn.Close()
+
+	remoteAddr := f.Remote.String()
+	if f.Resolver != nil {
+		addr, err := resolveAddr(context.Background(), f.Resolver, remoteAddr)
+		if err != nil {
+			slog.Error("remote resolve error", "err", err)
+			return
+		}
+		slog.Debug(fmt.Sprintf("resolved %s to %s", remoteAddr, addr))
+		remoteAddr = addr
+	}
+
+	var remoteConn net.Conn
+	var err error
+	client := f.sharedClient()
+	switch {
+	case client == nil && f.ControlPath != "":
+		remoteConn, err = DialControl(f.ControlPath, remoteAddr)
+	case client == nil:
+		var sshConfig *ssh.ClientConfig
+		sshConfig, err = f.Bastion.GetSSHConfig()
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
+
+		if err = prepare(f.Bastion); err != nil {
+			slog.Error(err.Error())
+			return
+		}
+		client, err = ssh.Dial(addressFamily, f.Bastion.String(), sshConfig)
+		if err != nil {
+			slog.Error("server dial error", "err", err)
+			return
+		}
+		defer client.Close()
+		slog.Debug(fmt.Sprintf("connected to %s (1 of 2)", f.Bastion.String()))
+		remoteConn, err = client.Dial(remoteNetwork(remoteAddr), remoteAddr)
+	default:
+		remoteConn, err = client.Dial(remoteNetwork(remoteAddr), remoteAddr)
+	}
 	if err != nil {
 		slog.Error("remote dial error", "err", err)
 		return
 	}
-	slog.Debug(fmt.Sprintf("connected to %s (2 of 2)", remoteHost.String()))
+	defer remoteConn.Close()
+	slog.Debug(fmt.Sprintf("connected to %s (2 of 2)", f.Remote.String()))
 
-	copyConn := func(writer, reader net.Conn) {
-		_, err := io.Copy(writer, reader)
+	if f.ProxyProtocol {
+		header, err := proxyProtocolHeader(localConn.RemoteAddr(), localConn.LocalAddr())
 		if err != nil {
+			slog.Error("proxy protocol error", "err", err)
+			return
+		}
+		if _, err := remoteConn.Write(header); err != nil {
+			slog.Error("proxy protocol write error", "err", err)
+			return
+		}
+	}
+
+	var localReader, remoteReader io.Reader = &countingReader{localConn, &f.transferred}, &countingReader{remoteConn, &f.transferred}
+	if limiter := f.rateLimiter(); limiter != nil {
+		localReader = limiter.Reader(localReader)
+		remoteReader = limiter.Reader(remoteReader)
+	}
+
+	done := make(chan struct{}, 2)
+	copyConn := func(writer net.Conn, reader io.Reader) {
+		_, err := io.Copy(writer, reader)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			slog.Error("io.Copy error", "err", err)
 		}
+		done <- struct{}{}
 	}
-	go copyConn(localConn, remoteConn)
-	go copyConn(remoteConn, localConn)
+	go copyConn(localConn, remoteReader)
+	go copyConn(remoteConn, localReader)
+
+	// once either side finishes, the deferred closes stop the other copy
+	<-done
 }
 
-func Connect(bastionEndpoints ...EndpointIface) error {
+// Stats returns the number of connections being forwarded and the total bytes
+// transferred in both directions
+func (f *Forwarder) Stats() (int64, int64) {
+	return f.active.Load(), f.transferred.Load()
+}
+
+// countingReader adds the bytes read to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// rateLimiter returns the limiter for a new connection, which is shared
+// between all connections when the limit is aggregate
+func (f *Forwarder) rateLimiter() *RateLimiter {
+	if f.RateLimit <= 0 {
+		return nil
+	}
+	if !f.AggregateRateLimit {
+		return NewRateLimiter(float64(f.RateLimit))
+	}
+
+	f.limiterOnce.Do(func() {
+		f.limiter = NewRateLimiter(float64(f.RateLimit))
+	})
+	return f.limiter
+}
+
+// Pipe connects stdin and stdout to a plain TCP connection to addr, this lets
+// amz-ssh be used as an OpenSSH ProxyCommand where ssh does the authentication
+func Pipe(addr string) error {
+	conn, err := net.Dial(addressFamily, addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+	slog.Debug("Piping stdio to " + addr)
+
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			slog.Error("io.Copy error", "err", err)
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
 
-	var client *ssh.Client
-	for _, bastionEndpoint := range bastionEndpoints {
+// Dial connects to the first endpoint and then hops through each of the
+// following endpoints over the previous connection, returning the client of
+// the last hop.
+func Dial(bastionEndpoints ...EndpointIface) (*ssh.Client, error) {
+	if len(bastionEndpoints) == 0 {
+		return nil, errors.New("no endpoints to connect to")
+	}
+	return DialFrom(nil, bastionEndpoints...)
+}
+
+// clientPaths records the hops each client was dialled through, for Path
+var clientPaths sync.Map
+
+// Path describes the hops a client returned by Dial or DialFrom goes
+// through, eg "i-0abc (1.2.3.4) -> i-0def (10.0.0.5) as ec2-user"
+func Path(client *ssh.Client) string {
+	hops, _ := clientPaths.Load(client)
+	path, _ := hops.([]string)
+	return fmt.Sprintf("%s as %s", strings.Join(path, " -> "), client.User())
+}
+
+func hopName(endpoint EndpointIface, addr string) string {
+	if e, ok := endpoint.(*EC2Endpoint); ok {
+		return fmt.Sprintf("%s (%s)", e.InstanceID, e.Host())
+	}
+	return addr
+}
+
+// DialFrom extends an already established client through further endpoints.
+func DialFrom(client *ssh.Client, bastionEndpoints ...EndpointIface) (*ssh.Client, error) {
+	var path []string
+	if client != nil {
+		if hops, ok := clientPaths.Load(client); ok {
+			path = hops.([]string)
+		}
+	}
+
+	for i, bastionEndpoint := range bastionEndpoints {
+		hop := fmt.Sprintf("hop %d of %d", i+1, len(bastionEndpoints))
 		sshConfig, err := bastionEndpoint.GetSSHConfig()
 		if err != nil {
-			return nil
+			return nil, fmt.Errorf("failed to get ssh config (%s): %w", hop, err)
 		}
 
+		start := time.Now()
+		if err := prepare(bastionEndpoint); err != nil {
+			return nil, fmt.Errorf("%s: %w", hop, err)
+		}
 		serviceAddr := bastionEndpoint.String()
-		slog.Debug("Attempting to connect to " + serviceAddr)
-		// Tf this is the first endpoint in the chain, create a new client
-		// Otherwise use the previous ssh client
-		if client == nil {
-			client, err = ssh.Dial("tcp", serviceAddr, sshConfig)
-			if err != nil {
-				return fmt.Errorf("failed to dial: %s", err)
-			}
-		} else {
-			conn, err := client.Dial("tcp", serviceAddr)
-			if err != nil {
-				return fmt.Errorf("failed to dial: %s", err)
-			}
-			ncc, chans, reqs, err := ssh.NewClientConn(conn, serviceAddr, sshConfig)
-			if err != nil {
-				return fmt.Errorf("failed to create new ssh connection to %s: %s", serviceAddr, err)
-			}
-			client = ssh.NewClient(ncc, chans, reqs)
+		slog.Debug("Attempting to connect to "+serviceAddr, "hop", hop, "resolved_in", time.Since(start))
+		RecordTiming("resolve "+hop, start)
+
+		start = time.Now()
+		next, err := dialHop(client, serviceAddr, sshConfig, hop)
+		// a freshly pushed key can take a moment to be accepted by the instance
+		for attempt := 1; isAuthError(err) && pushesKey(bastionEndpoint) && attempt <= keyPropagationRetries; attempt++ {
+			slog.Debug("authentication failed, waiting for the pushed key to propagate", "hop", hop, "attempt", attempt)
+			time.Sleep(time.Duration(attempt) * keyPropagationDelay)
+			next, err = dialHop(client, serviceAddr, sshConfig, hop)
 		}
+		if err != nil {
+			return nil, err
+		}
+		client = next
+		slog.Debug("Connected to "+serviceAddr, "hop", hop, "took", time.Since(start))
+		path = append(path[:len(path):len(path)], hopName(bastionEndpoint, serviceAddr))
+		clientPaths.Store(client, path)
+	}
+
+	if client == nil {
+		return nil, errors.New("no ssh client was established")
+	}
+	return client, nil
+}
+
+// keyPropagationRetries is how many more times authentication is tried after
+// pushing a key, waiting keyPropagationDelay longer each time
+const (
+	keyPropagationRetries = 3
+	keyPropagationDelay   = 500 * time.Millisecond
+)
+
+// dialHop connects to serviceAddr, directly when client is nil and otherwise
+// through client
+func dialHop(client *ssh.Client, serviceAddr string, sshConfig *ssh.ClientConfig, hop string) (*ssh.Client, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if client == nil {
+		conn, err = net.DialTimeout(addressFamily, serviceAddr, sshConfig.Timeout)
+	} else {
+		conn, err = client.Dial(remoteNetwork(serviceAddr), serviceAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s (%s): %s", serviceAddr, hop, err)
+	}
+	RecordTiming("tcp dial "+hop, start)
+
+	handshake := time.Now()
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, serviceAddr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create new ssh connection to %s (%s): %w", serviceAddr, hop, err)
+	}
+	RecordTiming("ssh handshake "+hop, handshake)
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// isAuthError reports whether the server rejected every key offered, the ssh
+// package only describes this in the error's text
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// pushesKey reports whether endpoint authenticates with a key pushed via
+// Instance Connect, which may not be active straight away
+func pushesKey(endpoint EndpointIface) bool {
+	e, ok := endpoint.(*EC2Endpoint)
+	return ok && !e.SkipKeys && e.CA == nil && !e.pushDenied
+}
+
+func Connect(bastionEndpoints ...EndpointIface) error {
+	client, err := Dial(bastionEndpoints...)
+	if err != nil {
+		return err
+	}
+	slog.Info("connected via " + Path(client))
+
+	return Shell(client)
+}
+
+// PtyMode decides whether a shell requests a pseudo terminal from the server
+type PtyMode int
+
+const (
+	// PtyAuto requests a pty when stdin is a terminal
+	PtyAuto PtyMode = iota
+	// PtyNever never requests a pty, for piping through the shell
+	PtyNever
+	// PtyForce requests a pty even without a local terminal, for commands that need one
+	PtyForce
+)
+
+// ShellOptions changes how ShellWithOptions runs the session
+type ShellOptions struct {
+	// Pty decides whether a pseudo terminal is requested
+	Pty PtyMode
+	// Recorder is given everything the session shows, when set
+	Recorder *Recorder
+	// InputAudit is given everything typed into the session, including
+	// anything sensitive such as passwords, when set
+	InputAudit io.Writer
+	// Escapes enables OpenSSH style ~ escapes from a local terminal, such as
+	// ~C to add forwards during the session, restricted by Allow
+	Escapes bool
+	Allow   Allowlist
+}
+
+// Shell runs an interactive shell over an established client, this allows
+// tunnels to share the same client as the shell.
+func Shell(client *ssh.Client) error {
+	return ShellWithOptions(client, ShellOptions{})
+}
+
+// ShellWithOptions runs a shell like Shell, as opts describes
+func ShellWithOptions(client *ssh.Client, opts ShellOptions) error {
+	if client == nil {
+		return errors.New("no ssh client to open a shell on")
 	}
 
 	sess, err := client.NewSession()
@@ -98,9 +568,16 @@ func Connect(bastionEndpoints ...EndpointIface) error {
 	defer sess.Close()
 
 	// Set IO
-	sess.Stdout = os.Stdout
-	sess.Stderr = os.Stderr
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if opts.Recorder != nil {
+		stdout, stderr = io.MultiWriter(stdout, opts.Recorder), io.MultiWriter(stderr, opts.Recorder)
+	}
+	sess.Stdout = stdout
+	sess.Stderr = stderr
 	sess.Stdin = os.Stdin
+	if opts.InputAudit != nil {
+		sess.Stdin = io.TeeReader(os.Stdin, opts.InputAudit)
+	}
 
 	modes := ssh.TerminalModes{
 		ssh.ECHO:          1,
@@ -109,28 +586,53 @@ func Connect(bastionEndpoints ...EndpointIface) error {
 	}
 
 	fileDescriptor := int(os.Stdin.Fd())
+	isTerminal := term.IsTerminal(fileDescriptor)
 
-	if term.IsTerminal(fileDescriptor) {
-		originalState, err := term.MakeRaw(fileDescriptor)
-		if err != nil {
-			return nil
-		}
-		defer term.Restore(fileDescriptor, originalState)
-
-		termWidth, termHeight, err := term.GetSize(fileDescriptor)
+	// without a local terminal there's no size to copy, so the usual default is used
+	termWidth, termHeight := 80, 24
+	if isTerminal {
+		termWidth, termHeight, err = term.GetSize(fileDescriptor)
 		if err != nil {
 			return err
 		}
+	}
+	if opts.Recorder != nil {
+		if err := opts.Recorder.Start(termWidth, termHeight); err != nil {
+			return fmt.Errorf("failed to start recording: %w", err)
+		}
+	}
 
-		err = sess.RequestPty("xterm-256color", termHeight, termWidth, modes)
-		if err != nil {
-			return err
+	if opts.Pty == PtyForce || (opts.Pty == PtyAuto && isTerminal) {
+		// Some hardened sshd configs refuse PTY allocation, a plain session
+		// still works so carry on without one rather than failing
+		if err := sess.RequestPty("xterm-256color", termHeight, termWidth, modes); err != nil {
+			slog.Warn("pty allocation refused, continuing without a pty", "err", err)
+		} else if isTerminal {
+			originalState, err := term.MakeRaw(fileDescriptor)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(fileDescriptor, originalState)
+
+			if opts.Escapes {
+				escapes := newEscapeReader(sess.Stdin, os.Stderr, client, opts.Allow)
+				defer escapes.Close()
+				sess.Stdin = escapes
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			watchWindowSize(fileDescriptor, done, func(width, height int) {
+				sess.WindowChange(height, width)
+				if opts.Recorder != nil {
+					opts.Recorder.Resize(width, height)
+				}
+			})
 		}
 	}
 
 	if err := sess.Shell(); err != nil {
-		slog.Error("failed to start shell", "err", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to start shell: %w", err)
 	}
 
 	return sess.Wait()
@@ -0,0 +1,33 @@
+package sshutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestForwarderRefusesConnectionsAfterShutdown(t *testing.T) {
+	var f Forwarder
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if f.track(local, true) {
+		t.Error("a connection was tracked after Shutdown")
+	}
+	if _, err := local.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("write to a refused connection = %v, want it closed", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Serve(listener); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() after Shutdown = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,114 @@
+package sshutils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// ControlSocketExists reports whether path is a socket, such as one left by an
+// OpenSSH ControlMaster connection to the bastion
+func ControlSocketExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// DialControl opens a connection to addr through the OpenSSH ControlMaster
+// listening on path, by running ssh -W over the existing multiplexed session.
+// The master's own connection decides where addr is dialled from.
+func DialControl(path, addr string) (net.Conn, error) {
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, fmt.Errorf("using a control socket needs the OpenSSH client: %w", err)
+	}
+
+	// the host is required by ssh but is ignored as the master is reused
+	cmd := exec.Command(sshPath, "-S", path, "-o", "ControlMaster=no", "-W", addr, "control-master")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run ssh through %s: %w", path, err)
+	}
+	slog.Debug("dialling "+addr+" through control socket", "path", path)
+
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: addr}, nil
+}
+
+// DialFromControl connects to the first endpoint through the ControlMaster at
+// path and then hops through the rest, like DialFrom. The bastion the master
+// is connected to takes the place of amz-ssh's own first hop.
+func DialFromControl(path string, bastionEndpoints ...EndpointIface) (*ssh.Client, error) {
+	if len(bastionEndpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints to connect to through %s", path)
+	}
+
+	first := bastionEndpoints[0]
+	sshConfig, err := first.GetSSHConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ssh config: %w", err)
+	}
+
+	if err := prepare(first); err != nil {
+		return nil, err
+	}
+	serviceAddr := first.String()
+	conn, err := DialControl(path, serviceAddr)
+	if err != nil {
+		return nil, err
+	}
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, serviceAddr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create new ssh connection to %s through %s: %s", serviceAddr, path, err)
+	}
+	client := ssh.NewClient(ncc, chans, reqs)
+	clientPaths.Store(client, []string{"control master " + path, hopName(first, serviceAddr)})
+
+	return DialFrom(client, bastionEndpoints[1:]...)
+}
+
+// commandConn is a net.Conn over the stdin and stdout of an ssh -W process
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   string
+}
+
+func (c *commandConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("ssh") }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr(c.addr) }
+
+// deadlines aren't supported over a pipe, they are accepted and ignored
+func (c *commandConn) SetDeadline(time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(time.Time) error { return nil }
+
+type commandAddr string
+
+func (a commandAddr) Network() string { return "ssh" }
+func (a commandAddr) String() string  { return string(a) }
@@ -4,33 +4,143 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	connect "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
 	connecttypes "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect/types"
+	"github.com/aws/smithy-go"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
 )
 
+// instanceIDPattern matches both the short and long EC2 instance id formats
+var instanceIDPattern = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+
 type EC2Endpoint struct {
 	InstanceID string
 	Port       int
 	User       string
-	PrivateKey string
-	PublicKey  string
-	UsePrivate bool
+	// ConnectUser is the OS user the public key is pushed for, defaults to User
+	ConnectUser string
+	PrivateKey  string
+	PublicKey   string
+	UsePrivate  bool
+	// UseDNS connects via the instance's DNS name instead of its IP
+	UseDNS bool
+	// PreferIPv6 uses the instance's IPv6 address for private connections when it has one
+	PreferIPv6 bool
+	// Hostname is connected to instead of the instance's own address, such as
+	// a load balancer in front of it
+	Hostname string
+	// NetworkInterface selects an ENI id or secondary private IP to connect to
+	// instead of the instance's primary address
+	NetworkInterface string
+	// KeyComment is added to the generated public key
+	KeyComment string
+	// KeyType and KeyBits choose the generated key, eg ed25519 for newer
+	// AMIs, the default is a DefaultRSABits RSA key
+	KeyType string
+	KeyBits int
+	// SkipKeys disables key generation and pushing for endpoints that are
+	// only used as a transport, where authentication is done by another ssh
+	// client, or that authenticate with Identities such as a certificate
+	SkipKeys bool
+
+	// CA signs the generated key into a certificate valid for CertValidity,
+	// which is used instead of pushing the key when the server trusts the CA
+	CA           ssh.Signer
+	CertValidity time.Duration
+
+	// Region the instance is in, when empty the clients' default region is
+	// used to find it and its availability zone decides where the key is pushed
+	Region string
+	// AvailabilityZone overrides the instance's zone sent with the key, for
+	// Local Zone, Wavelength or Outposts instances whose placement doesn't
+	// match what Instance Connect expects
+	AvailabilityZone string
+	// AWSTimeout bounds the AWS requests made when the endpoint is dialled,
+	// such as pushing its key, there's no limit when it's 0
+	AWSTimeout time.Duration
+
+	ClientOptions
+
+	// pushDenied is set when the key couldn't be pushed and the fallback
+	// identities or agent are used instead
+	pushDenied bool
 
-	Instance      *ec2types.Instance
+	Instance *ec2types.Instance
+	// Backends are further instances the key is pushed to, for when Hostname
+	// may send the connection to any of them
+	Backends      []*ec2types.Instance
 	EC2Client     *ec2.Client
 	ConnectClient *connect.Client
+	Clients       *Clients
+}
+
+// EC2EndpointOption configures an EC2Endpoint before its keys are generated
+type EC2EndpointOption func(*EC2Endpoint)
+
+// WithKeyComment sets the comment of the generated public key
+func WithKeyComment(comment string) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.KeyComment = comment
+	}
+}
+
+// WithClientOptions sets the ssh client settings, before the keys are
+// generated so that they can follow FIPS mode
+func WithClientOptions(opts ClientOptions) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.ClientOptions = opts
+	}
+}
+
+// WithClients lets the endpoint create clients for the region the instance is in
+func WithClients(clients *Clients) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.Clients = clients
+	}
+}
+
+// WithAvailabilityZone overrides the availability zone the key is pushed for
+func WithAvailabilityZone(az string) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.AvailabilityZone = az
+	}
+}
+
+// WithAWSTimeout bounds the AWS requests made when the endpoint is dialled
+func WithAWSTimeout(timeout time.Duration) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.AWSTimeout = timeout
+	}
+}
+
+// WithCA signs the generated key with ca rather than pushing it, giving a
+// certificate that's valid for validity
+func WithCA(ca ssh.Signer, validity time.Duration) EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.CA = ca
+		e.CertValidity = validity
+	}
 }
 
-func NewEC2Endpoint(ctx context.Context, InstanceID string, ec2Client *ec2.Client, connectClient *connect.Client) (*EC2Endpoint, error) {
+// WithoutKeys skips generating and pushing a key pair for the endpoint
+func WithoutKeys() EC2EndpointOption {
+	return func(e *EC2Endpoint) {
+		e.SkipKeys = true
+	}
+}
+
+func NewEC2Endpoint(ctx context.Context, InstanceID string, ec2Client *ec2.Client, connectClient *connect.Client, opts ...EC2EndpointOption) (*EC2Endpoint, error) {
 	endpoint := EC2Endpoint{
 		InstanceID:    InstanceID,
 		User:          "ec2-user",
@@ -40,6 +150,13 @@ func NewEC2Endpoint(ctx context.Context, InstanceID string, ec2Client *ec2.Clien
 	}
 	var err error
 
+	addr, options, _ := strings.Cut(endpoint.InstanceID, ",")
+	endpoint.InstanceID = addr
+	settings, err := ParseEndpointOptions(options)
+	if err != nil {
+		return &endpoint, err
+	}
+
 	if parts := strings.Split(endpoint.InstanceID, "@"); len(parts) > 1 {
 		endpoint.User = parts[0]
 		endpoint.InstanceID = parts[1]
@@ -50,51 +167,401 @@ func NewEC2Endpoint(ctx context.Context, InstanceID string, ec2Client *ec2.Clien
 		endpoint.Port, _ = strconv.Atoi(parts[1])
 	}
 
-	endpoint.PrivateKey, endpoint.PublicKey, err = GenerateKeys()
-	if err != nil {
-		return &endpoint, err
+	if net.ParseIP(strings.Trim(endpoint.InstanceID, "[]")) != nil {
+		return &endpoint, fmt.Errorf("%s is an IP address rather than an instance id, use NewEndpoint to connect to it directly", endpoint.InstanceID)
+	}
+	if !instanceIDPattern.MatchString(endpoint.InstanceID) {
+		return &endpoint, fmt.Errorf("%s is not a valid instance id, expected i-xxxxxxxx or i-xxxxxxxxxxxxxxxxx", endpoint.InstanceID)
 	}
 
+	for _, opt := range opts {
+		opt(&endpoint)
+	}
+
+	// settings given with the destination take precedence over the options
+	for k, v := range settings {
+		switch k {
+		case "region":
+			endpoint.Region = v
+		case "key":
+			endpoint.KeyType = v
+		case "az":
+			endpoint.AvailabilityZone = v
+		case "hostkey":
+			endpoint.HostKeyFingerprint = v
+		case "bits":
+			if endpoint.KeyBits, err = strconv.Atoi(v); err != nil {
+				return &endpoint, fmt.Errorf("%s is not a valid number of key bits", v)
+			}
+		default:
+			return &endpoint, fmt.Errorf("unknown destination option %s", k)
+		}
+	}
+
+	if endpoint.Region != "" {
+		if endpoint.Clients == nil {
+			return &endpoint, fmt.Errorf("no clients available for region %s", endpoint.Region)
+		}
+		endpoint.EC2Client = endpoint.Clients.EC2(endpoint.Region)
+		endpoint.ConnectClient = endpoint.Clients.Connect(endpoint.Region)
+	}
+
+	if !endpoint.SkipKeys {
+		if err := checkKeyType(endpoint.KeyType, endpoint.KeyBits, endpoint.FIPS); err != nil {
+			return &endpoint, fmt.Errorf("%s: %w", endpoint.InstanceID, err)
+		}
+		start := time.Now()
+		endpoint.PrivateKey, endpoint.PublicKey, err = GenerateKeyPair(endpoint.KeyType, endpoint.KeyBits, endpoint.KeyComment)
+		if err != nil {
+			return &endpoint, err
+		}
+		RecordTiming("generate key for "+endpoint.InstanceID, start)
+	}
+
+	start := time.Now()
 	endpoint.Instance, err = getEC2Instance(ctx, endpoint.InstanceID, endpoint.EC2Client)
 	if err != nil {
 		return &endpoint, err
 	}
+	RecordTiming("describe "+endpoint.InstanceID, start)
+
+	// the key has to be pushed to the Instance Connect API of the instance's own region
+	if endpoint.Region == "" && endpoint.Clients != nil {
+		region := regionFromAZ(endpoint.availabilityZone(endpoint.Instance))
+		if region != "" && region != endpoint.Clients.Region() {
+			slog.Debug(fmt.Sprintf("%s is in %s, pushing keys to that region", endpoint.InstanceID, region))
+			endpoint.ConnectClient = endpoint.Clients.Connect(region)
+		}
+	}
 
 	return &endpoint, nil
 }
 
+// ParseEndpointOptions parses the comma separated key=value options that may
+// follow a destination, eg ubuntu@i-0abc:22,region=eu-west-1,key=ed25519
+func ParseEndpointOptions(s string) (map[string]string, error) {
+	settings := map[string]string{}
+	if s == "" {
+		return settings, nil
+	}
+
+	for _, option := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(option, "=")
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("%s is not a valid destination option, use key=value", option)
+		}
+		settings[k] = v
+	}
+	return settings, nil
+}
+
 func (e *EC2Endpoint) String() string {
-	err := sendPublicKey(context.TODO(), e.Instance, e.User, e.PublicKey, e.ConnectClient)
-	if err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
+	addr := e.Address()
+	slog.Debug("Resolved "+e.InstanceID, "addr", addr, "private", e.UsePrivate)
+	return addr
+}
+
+// Prepare readies the endpoint to be dialled by pushing its key, Dial calls it
+// for each hop. When pushing is denied and there's another way to
+// authenticate that's used instead.
+func (e *EC2Endpoint) Prepare(ctx context.Context) error {
+	// there's no point pushing a key to an instance that can't be reached,
+	// and an empty host would be dialled as just :22
+	if err := e.CheckAddress(); err != nil {
+		return err
+	}
+	if e.SkipKeys || e.CA != nil {
+		return nil
+	}
+
+	if e.AWSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.AWSTimeout)
+		defer cancel()
+	}
+	err := e.PushKey(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("pushing the key to %s timed out after %s, check your network or raise --aws-timeout: %w", e.InstanceID, e.AWSTimeout, err)
+	}
+	if errors.Is(err, ErrPushDenied) && e.hasFallbackAuth() {
+		slog.Warn(err.Error() + ", authenticating with --identity or the ssh agent instead")
+		e.pushDenied = true
+		return nil
+	}
+	return err
+}
+
+func (e *EC2Endpoint) connectUser() string {
+	if e.ConnectUser != "" {
+		return e.ConnectUser
+	}
+	return e.User
+}
+
+// PushKey sends the public key to the instance and its backends via Instance
+// Connect without connecting, the key is then valid for 60 seconds
+func (e *EC2Endpoint) PushKey(ctx context.Context) error {
+	for _, instance := range append([]*ec2types.Instance{e.Instance}, e.Backends...) {
+		if err := pushPublicKey(ctx, instance, e.availabilityZone(instance), e.connectUser(), e.PublicKey, e.ConnectClient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// availabilityZone returns the zone the key is pushed for, AvailabilityZone
+// overrides the placement of the endpoint's own instance but not its backends
+func (e *EC2Endpoint) availabilityZone(instance *ec2types.Instance) string {
+	if e.AvailabilityZone != "" && instance == e.Instance {
+		return e.AvailabilityZone
+	}
+	if instance.Placement == nil {
+		return ""
+	}
+	return aws.ToString(instance.Placement.AvailabilityZone)
+}
+
+// Address returns the host:port of the instance without pushing the public key
+func (e *EC2Endpoint) Address() string {
+	return net.JoinHostPort(e.Host(), strconv.Itoa(e.Port))
+}
+
+// CheckAddress returns a descriptive error when the instance has no address
+// of the kind that was asked for, such as no public IP
+func (e *EC2Endpoint) CheckAddress() error {
+	if e.Host() != "" {
+		return nil
+	}
+
+	kind := "IP address"
+	if e.UseDNS {
+		kind = "DNS name"
 	}
 	if e.UsePrivate {
-		return fmt.Sprintf("%s:%d", aws.ToString(e.Instance.PrivateIpAddress), e.Port)
+		return fmt.Errorf("%s has no private %s", e.InstanceID, kind)
+	}
+	return fmt.Errorf("%s has no public %s, use --use-private from inside the VPC or connect through an EC2 Instance Connect Endpoint", e.InstanceID, kind)
+}
+
+// Host returns the IP or DNS name that will be used to reach the instance, this
+// is empty when the instance has no address of the requested kind
+func (e *EC2Endpoint) Host() string {
+	if e.Hostname != "" {
+		return e.Hostname
+	}
+
+	if e.UseDNS && e.NetworkInterface == "" {
+		if e.UsePrivate {
+			return aws.ToString(e.Instance.PrivateDnsName)
+		}
+		return aws.ToString(e.Instance.PublicDnsName)
+	}
+
+	publicIP := aws.ToString(e.Instance.PublicIpAddress)
+	privateIP := aws.ToString(e.Instance.PrivateIpAddress)
+	ipv6 := aws.ToString(e.Instance.Ipv6Address)
+	if e.NetworkInterface != "" {
+		publicIP, privateIP, ipv6 = e.interfaceAddresses()
+	}
+
+	if e.UsePrivate {
+		if e.PreferIPv6 && ipv6 != "" {
+			return ipv6
+		}
+		return privateIP
 	}
 
-	return fmt.Sprintf("%s:%d", aws.ToString(e.Instance.PublicIpAddress), e.Port)
+	// IPv6 addresses are reachable from outside the VPC too
+	if addressFamily == "tcp6" && ipv6 != "" {
+		return ipv6
+	}
+	return publicIP
+}
+
+// AddBackend looks up another instance the key is pushed to, for endpoints
+// whose Hostname balances connections over several instances
+func (e *EC2Endpoint) AddBackend(ctx context.Context, instanceID string) error {
+	instance, err := getEC2Instance(ctx, instanceID, e.EC2Client)
+	if err != nil {
+		return fmt.Errorf("%s: %w", instanceID, err)
+	}
+	e.Backends = append(e.Backends, instance)
+	return nil
+}
+
+// SelectNetworkInterface makes the endpoint connect via the given ENI id or
+// secondary private IP, returning an error if the instance doesn't have it
+func (e *EC2Endpoint) SelectNetworkInterface(id string) error {
+	e.NetworkInterface = id
+	if _, privateIP, _ := e.interfaceAddresses(); privateIP == "" {
+		e.NetworkInterface = ""
+		return fmt.Errorf("instance %s has no network interface or private IP %s", e.InstanceID, id)
+	}
+	return nil
+}
+
+// interfaceAddresses returns the public, private and IPv6 address of the selected network interface
+func (e *EC2Endpoint) interfaceAddresses() (string, string, string) {
+	for _, ni := range e.Instance.NetworkInterfaces {
+		var ipv6 string
+		if len(ni.Ipv6Addresses) > 0 {
+			ipv6 = aws.ToString(ni.Ipv6Addresses[0].Ipv6Address)
+		}
+		if aws.ToString(ni.NetworkInterfaceId) == e.NetworkInterface {
+			return associationIP(ni.Association), aws.ToString(ni.PrivateIpAddress), ipv6
+		}
+		for _, addr := range ni.PrivateIpAddresses {
+			if aws.ToString(addr.PrivateIpAddress) == e.NetworkInterface {
+				return associationIP(addr.Association), aws.ToString(addr.PrivateIpAddress), ipv6
+			}
+		}
+	}
+	return "", "", ""
+}
+
+func associationIP(association *ec2types.InstanceNetworkInterfaceAssociation) string {
+	if association == nil {
+		return ""
+	}
+	return aws.ToString(association.PublicIp)
 }
 
 func (e *EC2Endpoint) GetSSHConfig() (*ssh.ClientConfig, error) {
+	if e.SkipKeys {
+		return e.clientConfig(e.User, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return e.fallbackSigners()
+		})), nil
+	}
+
 	key, err := ssh.ParsePrivateKey([]byte(e.PrivateKey))
 	if err != nil {
 		return nil, err
 	}
+	if e.CA != nil {
+		cert, err := SignUserCertificate(key.PublicKey(), e.CA, e.User, "amz-ssh "+e.InstanceID, e.CertValidity)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = ssh.NewCertSigner(cert, key); err != nil {
+			return nil, err
+		}
+	}
+	signers := append([]ssh.Signer{key}, e.Identities...)
 
-	return &ssh.ClientConfig{
-		User: e.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}, nil
+	// Prepare pushes the key after the config is built, so whether the push
+	// was denied is only known once authentication starts
+	return e.clientConfig(e.User, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if e.pushDenied {
+			return e.fallbackSigners()
+		}
+		return signers, nil
+	})), nil
 }
 
-func sendPublicKey(ctx context.Context, instance *ec2types.Instance, user, publicKey string, client *connect.Client) error {
+// hasFallbackAuth reports whether there's a way to authenticate without the pushed key
+func (e *EC2Endpoint) hasFallbackAuth() bool {
+	return len(e.Identities) > 0 || e.agentSocket() != ""
+}
+
+// ErrPushDenied is returned when IAM doesn't allow ec2-instance-connect:SendSSHPublicKey
+var ErrPushDenied = errors.New("not permitted to push keys via Instance Connect")
+
+// Instance Connect keys are only valid for 60 seconds, so a successful push is
+// reused for a little less than that before the key is sent again
+const pushedKeyTTL = 50 * time.Second
+
+// pushedKeys records when each instance, user and key combination was last
+// sent so that every hop and tunnel connection doesn't push it again.
+// inFlight holds the pushes under way, closed once they finish, so the same
+// key isn't sent twice at once.
+var pushedKeys = struct {
+	sync.Mutex
+	sent     map[string]time.Time
+	inFlight map[string]chan struct{}
+}{sent: map[string]time.Time{}, inFlight: map[string]chan struct{}{}}
+
+// keyPushLimiter smooths bursts of SendSSHPublicKey calls, which share an API
+// quota with everyone else in the account
+var keyPushLimiter *RateLimiter
+
+// SetKeyPushRate limits how many keys are pushed per second, 0 is unlimited
+func SetKeyPushRate(perSecond float64) {
+	if perSecond <= 0 {
+		keyPushLimiter = nil
+		return
+	}
+	keyPushLimiter = NewRateLimiter(perSecond)
+}
+
+// pushPublicKey sends the public key unless the same key was already sent to the
+// instance for the user within pushedKeyTTL. The lock is only held to check
+// and record pushes, so different keys are pushed in parallel.
+func pushPublicKey(ctx context.Context, instance *ec2types.Instance, az, user, publicKey string, client *connect.Client) error {
+	key := aws.ToString(instance.InstanceId) + "/" + user + "/" + publicKey
+	var done chan struct{}
+	for done == nil {
+		pushedKeys.Lock()
+		if sent, ok := pushedKeys.sent[key]; ok && time.Since(sent) < pushedKeyTTL {
+			pushedKeys.Unlock()
+			slog.Debug("Public key already sent to " + aws.ToString(instance.InstanceId))
+			return nil
+		}
+		pending, ok := pushedKeys.inFlight[key]
+		if !ok {
+			done = make(chan struct{})
+			pushedKeys.inFlight[key] = done
+		}
+		pushedKeys.Unlock()
+
+		// the same key is already being pushed, once it has been this one
+		// is either not needed or, if that push failed, tried again
+		if ok {
+			select {
+			case <-pending:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	defer func() {
+		pushedKeys.Lock()
+		delete(pushedKeys.inFlight, key)
+		pushedKeys.Unlock()
+		close(done)
+	}()
+
+	start := time.Now()
+	if keyPushLimiter != nil {
+		if err := keyPushLimiter.Wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if err := sendPublicKey(ctx, instance, az, user, publicKey, client); err != nil {
+		return err
+	}
+	RecordTiming("push key to "+aws.ToString(instance.InstanceId), start)
+	slog.Debug("Public key sent to "+aws.ToString(instance.InstanceId), "user", user)
+
+	pushedKeys.Lock()
+	defer pushedKeys.Unlock()
+	// expired pushes are dropped so long running tunnels don't grow the map
+	for k, sent := range pushedKeys.sent {
+		if time.Since(sent) >= pushedKeyTTL {
+			delete(pushedKeys.sent, k)
+		}
+	}
+	pushedKeys.sent[key] = time.Now()
+	return nil
+}
+
+func sendPublicKey(ctx context.Context, instance *ec2types.Instance, az, user, publicKey string, client *connect.Client) error {
+	var zone *string
+	if az != "" {
+		zone = aws.String(az)
+	}
 
 	out, err := client.SendSSHPublicKey(ctx, &connect.SendSSHPublicKeyInput{
-		AvailabilityZone: instance.Placement.AvailabilityZone,
+		AvailabilityZone: zone,
 		InstanceId:       instance.InstanceId,
 		InstanceOSUser:   aws.String(user),
 		SSHPublicKey:     aws.String(publicKey),
@@ -107,6 +574,12 @@ func sendPublicKey(ctx context.Context, instance *ec2types.Instance, user, publi
 			return nil
 		}
 
+		var ae smithy.APIError
+		if errors.As(err, &ae) && ae.ErrorCode() == "AccessDeniedException" {
+			return fmt.Errorf("%w to %s, allow ec2-instance-connect:SendSSHPublicKey for your role or use --identity with a key already authorized on the instance",
+				ErrPushDenied, aws.ToString(instance.InstanceId))
+		}
+
 		return fmt.Errorf("send public key error: %w", err)
 	}
 
@@ -126,9 +599,11 @@ func getEC2Instance(ctx context.Context, id string, client *ec2.Client) (*ec2typ
 		return nil, err
 	}
 
-	if len(instanceOutput.Reservations) == 0 || len(instanceOutput.Reservations[0].Instances) == 0 {
-		return nil, errors.New("instance not found")
+	// a lookup by id has a single result, but not necessarily in the first reservation
+	for _, res := range instanceOutput.Reservations {
+		if len(res.Instances) > 0 {
+			return &res.Instances[0], nil
+		}
 	}
-
-	return &instanceOutput.Reservations[0].Instances[0], nil
+	return nil, errors.New("instance not found")
 }
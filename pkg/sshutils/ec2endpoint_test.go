@@ -0,0 +1,126 @@
+package sshutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	connect "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+)
+
+// fakeConnectClient returns an Instance Connect client whose requests are
+// counted and answered successfully
+func fakeConnectClient(t *testing.T, requests *atomic.Int64) *connect.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, `{"RequestId":"test","Success":true}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return connect.New(connect.Options{
+		Region:           "eu-west-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: connect.EndpointResolverFromURL(srv.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+}
+
+// resetPushedKeys forgets the keys pushed by earlier tests
+func resetPushedKeys() {
+	pushedKeys.Lock()
+	defer pushedKeys.Unlock()
+	pushedKeys.sent = map[string]time.Time{}
+}
+
+func TestPushPublicKeySendsOnce(t *testing.T) {
+	resetPushedKeys()
+	var requests atomic.Int64
+	client := fakeConnectClient(t, &requests)
+	instance := &ec2types.Instance{InstanceId: aws.String("i-0123456789abcdef0")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pushPublicKey(context.Background(), instance, "eu-west-1a", "ec2-user", "ssh-ed25519 AAAA once", client); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("sent the key %d times, want 1", got)
+	}
+}
+
+func TestPushPublicKeyPrunesExpired(t *testing.T) {
+	resetPushedKeys()
+	var requests atomic.Int64
+	client := fakeConnectClient(t, &requests)
+
+	pushedKeys.Lock()
+	pushedKeys.sent["i-expired/ec2-user/ssh-ed25519 AAAA old"] = time.Now().Add(-pushedKeyTTL)
+	pushedKeys.Unlock()
+
+	instance := &ec2types.Instance{InstanceId: aws.String("i-0123456789abcdef1")}
+	if err := pushPublicKey(context.Background(), instance, "eu-west-1a", "ec2-user", "ssh-ed25519 AAAA new", client); err != nil {
+		t.Fatal(err)
+	}
+
+	pushedKeys.Lock()
+	defer pushedKeys.Unlock()
+	if _, ok := pushedKeys.sent["i-expired/ec2-user/ssh-ed25519 AAAA old"]; ok {
+		t.Error("expired push wasn't pruned")
+	}
+	if _, ok := pushedKeys.sent["i-0123456789abcdef1/ec2-user/ssh-ed25519 AAAA new"]; !ok {
+		t.Error("new push wasn't recorded")
+	}
+}
+
+func TestPrepareTimesOut(t *testing.T) {
+	resetPushedKeys()
+	// the handler only answers once the test is over
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	endpoint := &EC2Endpoint{
+		InstanceID: "i-0123456789abcdef2",
+		User:       "ec2-user",
+		Port:       22,
+		PublicKey:  "ssh-ed25519 AAAA slow",
+		AWSTimeout: 50 * time.Millisecond,
+		Instance: &ec2types.Instance{
+			InstanceId:      aws.String("i-0123456789abcdef2"),
+			PublicIpAddress: aws.String("203.0.113.10"),
+		},
+		ConnectClient: connect.New(connect.Options{
+			Region:           "eu-west-1",
+			Credentials:      aws.AnonymousCredentials{},
+			EndpointResolver: connect.EndpointResolverFromURL(srv.URL),
+			Retryer:          aws.NopRetryer{},
+		}),
+	}
+
+	start := time.Now()
+	err := endpoint.Prepare(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Prepare() = %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Prepare() took %s with a 50ms timeout", elapsed)
+	}
+}
@@ -1,12 +1,20 @@
 package sshutils
 
 import (
+	"context"
+	"errors"
 	"fmt"
-
+	"io"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
 )
 
 type EndpointIface interface {
@@ -14,12 +22,74 @@ type EndpointIface interface {
 	GetSSHConfig() (*ssh.ClientConfig, error)
 }
 
+// preparer is implemented by endpoints with work to do before they can be
+// dialled, such as an EC2Endpoint pushing its key
+type preparer interface {
+	Prepare(ctx context.Context) error
+}
+
+// prepare readies endpoint to be dialled when it needs to be
+func prepare(endpoint EndpointIface) error {
+	if p, ok := endpoint.(preparer); ok {
+		return p.Prepare(context.TODO())
+	}
+	return nil
+}
+
+// ClientOptions holds the ssh client settings shared by every endpoint type
+type ClientOptions struct {
+	// Config restricts the ciphers, MACs and key exchanges negotiated with the server
+	Config ssh.Config
+	// HostKeyAlgorithms restricts the host key types accepted from the server
+	HostKeyAlgorithms []string
+	// Identities are offered after the endpoint's own key, they are what
+	// authenticates hosts that aren't reached via Instance Connect
+	Identities []ssh.Signer
+	// ClientVersion is the identification string sent to the server, the ssh
+	// package's default is used when it's empty
+	ClientVersion string
+	// FIPS is set by RestrictToFIPS, generated keys then have to be FIPS approved too
+	FIPS bool
+	// Timeout limits how long the TCP connection to the server may take, 0 is no limit
+	Timeout time.Duration
+	// KeyboardInteractive answers the server's keyboard-interactive challenges,
+	// such as a PAM TOTP prompt, on the terminal after the keys are tried
+	KeyboardInteractive bool
+	// BannerCallback is given the banner servers send before authentication,
+	// banners are discarded when it's nil
+	BannerCallback ssh.BannerCallback
+	// HostKeyFingerprint pins the server's host key to this SHA256
+	// fingerprint, any host key is accepted when it's empty
+	HostKeyFingerprint string
+	// IdentityAgent is the socket of the ssh agent to use, like OpenSSH's
+	// IdentityAgent, $SSH_AUTH_SOCK is used when it's empty
+	IdentityAgent string
+}
+
+func (o ClientOptions) clientConfig(user string, auth ...ssh.AuthMethod) *ssh.ClientConfig {
+	if o.KeyboardInteractive {
+		auth = append(auth, ssh.KeyboardInteractive(promptChallenge))
+	}
+	return &ssh.ClientConfig{
+		Config:            o.Config,
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   o.hostKeyCallback(),
+		HostKeyAlgorithms: o.HostKeyAlgorithms,
+		Timeout:           o.Timeout,
+		ClientVersion:     o.ClientVersion,
+		BannerCallback:    o.BannerCallback,
+	}
+}
+
 type Endpoint struct {
 	Host       string
 	Port       int
 	User       string
 	PrivateKey string
 	PublicKey  string
+
+	ClientOptions
 }
 
 func NewEndpoint(s string) *Endpoint {
@@ -32,9 +102,12 @@ func NewEndpoint(s string) *Endpoint {
 		endpoint.Host = parts[1]
 	}
 
-	if parts := strings.Split(endpoint.Host, ":"); len(parts) > 1 {
-		endpoint.Host = parts[0]
-		endpoint.Port, _ = strconv.Atoi(parts[1])
+	// IPv6 addresses are given in brackets when they have a port, eg [fd00::1]:22
+	if host, port, err := net.SplitHostPort(endpoint.Host); err == nil {
+		endpoint.Host = host
+		endpoint.Port, _ = strconv.Atoi(port)
+	} else {
+		endpoint.Host = strings.TrimSuffix(strings.TrimPrefix(endpoint.Host, "["), "]")
 	}
 
 	if endpoint.Port == 0 {
@@ -45,20 +118,172 @@ func NewEndpoint(s string) *Endpoint {
 }
 
 func (e *Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
 }
 
 func (e *Endpoint) GetSSHConfig() (*ssh.ClientConfig, error) {
-	key, err := ssh.ParsePrivateKey([]byte(e.PrivateKey))
+	var signers []ssh.Signer
+	if e.PrivateKey != "" {
+		key, err := ssh.ParsePrivateKey([]byte(e.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, key)
+	}
+	signers = append(signers, e.Identities...)
+
+	// Without any keys, such as for direct IP destinations, the ssh agent is used
+	if len(signers) == 0 {
+		agentAuth, err := e.agentAuthMethod()
+		if err != nil {
+			return nil, err
+		}
+		return e.clientConfig(e.User, agentAuth), nil
+	}
+
+	return e.clientConfig(e.User, ssh.PublicKeys(signers...)), nil
+}
+
+func (o ClientOptions) hostKeyCallback() ssh.HostKeyCallback {
+	if o.HostKeyFingerprint == "" {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	want := o.HostKeyFingerprint
+	if !strings.HasPrefix(want, "SHA256:") {
+		want = "SHA256:" + want
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != want {
+			return fmt.Errorf("host key of %s is %s, expected %s", hostname, got, want)
+		}
+		return nil
+	}
+}
+
+// promptChallenge asks the user each of the server's questions on the terminal,
+// hiding the answer unless the server asks for it to be echoed
+func promptChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	fd := int(os.Stdin.Fd())
+	if len(questions) > 0 && !term.IsTerminal(fd) {
+		return nil, errors.New("the server asked for keyboard-interactive authentication but stdin is not a terminal")
+	}
+
+	for _, line := range []string{name, instruction} {
+		if line != "" {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		fmt.Fprint(os.Stderr, question)
+		if echos[i] {
+			answer, err := ReadLine(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = strings.TrimRight(answer, "\r\n")
+			continue
+		}
+
+		answer, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = string(answer)
+	}
+	return answers, nil
+}
+
+// ReadLine reads up to and including a newline a byte at a time, so that
+// nothing typed or piped in after it is taken from in before the remote shell
+func ReadLine(in io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n > 0 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+func (o ClientOptions) agentAuthMethod() (ssh.AuthMethod, error) {
+	client, err := o.agentClient()
 	if err != nil {
 		return nil, err
 	}
+	return ssh.PublicKeysCallback(client.Signers), nil
+}
 
-	return &ssh.ClientConfig{
-		User: e.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}, nil
+// agentSocket is the socket of the ssh agent to use, empty when there's none
+func (o ClientOptions) agentSocket() string {
+	if o.IdentityAgent != "" {
+		return o.IdentityAgent
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// agents holds one connection per agent socket, shared by every endpoint and
+// handshake rather than each opening its own, until CloseAgents
+var agents = struct {
+	sync.Mutex
+	conns   map[string]net.Conn
+	clients map[string]agent.ExtendedAgent
+}{conns: map[string]net.Conn{}, clients: map[string]agent.ExtendedAgent{}}
+
+func (o ClientOptions) agentClient() (agent.ExtendedAgent, error) {
+	socket := o.agentSocket()
+	if socket == "" {
+		return nil, errors.New("no private key and SSH_AUTH_SOCK is not set, use --identity or an ssh agent")
+	}
+
+	agents.Lock()
+	defer agents.Unlock()
+	if client, ok := agents.clients[socket]; ok {
+		return client, nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh agent at %s: %w", socket, err)
+	}
+	// the client serialises requests, so it's shared along with the connection
+	client := agent.NewClient(conn)
+	agents.conns[socket] = conn
+	agents.clients[socket] = client
+	return client, nil
+}
+
+// CloseAgents closes the connections to ssh agents, once no more
+// connections will be authenticated
+func CloseAgents() {
+	agents.Lock()
+	defer agents.Unlock()
+	for socket, conn := range agents.conns {
+		conn.Close()
+		delete(agents.conns, socket)
+		delete(agents.clients, socket)
+	}
+}
+
+// fallbackSigners returns the keys used when a generated key can't be, the
+// given identities or otherwise the keys held by the ssh agent
+func (o ClientOptions) fallbackSigners() ([]ssh.Signer, error) {
+	if len(o.Identities) > 0 {
+		return o.Identities, nil
+	}
+
+	client, err := o.agentClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Signers()
 }
@@ -0,0 +1,59 @@
+package sshutils
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentConnectionShared(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+
+	var accepted atomic.Int64
+	closed := make(chan struct{})
+	go func() {
+		keyring := agent.NewKeyring()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	opts := ClientOptions{IdentityAgent: socket}
+	for i := 0; i < 3; i++ {
+		if _, err := opts.fallbackSigners(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.agentAuthMethod(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := accepted.Load(); got != 1 {
+		t.Errorf("opened %d agent connections, want 1", got)
+	}
+
+	CloseAgents()
+	<-closed
+	if _, err := opts.fallbackSigners(); err != nil {
+		t.Fatal(err)
+	}
+	if got := accepted.Load(); got != 2 {
+		t.Errorf("opened %d agent connections after CloseAgents, want 2", got)
+	}
+	CloseAgents()
+}
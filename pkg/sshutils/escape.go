@@ -0,0 +1,155 @@
+package sshutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const escapeHelp = `Supported escape sequences, at the start of a line:
+ ~C  - open a command line to add a forward, -L, -R or -D as on the command line
+ ~?  - this message
+ ~~  - send the escape character by typing it twice
+`
+
+// escapeReader passes a raw terminal's input on to the session, watching for
+// OpenSSH style ~ escapes at the start of a line. ~C adds forwards over client
+// while the session is open, so a port on the host doesn't need a reconnect.
+type escapeReader struct {
+	in     *bufio.Reader
+	out    io.Writer
+	client *ssh.Client
+	allow  Allowlist
+
+	// newline is set at the start of a line, where ~ begins an escape
+	newline bool
+	tilde   bool
+
+	mu       sync.Mutex
+	forwards []io.Closer
+}
+
+func newEscapeReader(in io.Reader, out io.Writer, client *ssh.Client, allow Allowlist) *escapeReader {
+	return &escapeReader{in: bufio.NewReader(in), out: out, client: client, allow: allow, newline: true}
+}
+
+func (r *escapeReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// return what's been read rather than block for more
+		if n > 0 && r.in.Buffered() == 0 {
+			break
+		}
+		b, err := r.in.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		if r.tilde {
+			r.tilde = false
+			switch b {
+			case 'C':
+				r.commandLine()
+				continue
+			case '?':
+				fmt.Fprint(r.out, "\r\n"+strings.ReplaceAll(escapeHelp, "\n", "\r\n"))
+				continue
+			case '~':
+			default:
+				// not an escape, so the ~ is sent and b handled as usual
+				r.in.UnreadByte()
+				b = '~'
+			}
+		} else if r.newline && b == '~' {
+			r.tilde = true
+			continue
+		}
+
+		p[n] = b
+		n++
+		r.newline = b == '\r' || b == '\n'
+	}
+	return n, nil
+}
+
+// commandLine reads a line with simple editing, as the terminal is raw, and
+// runs it. Ctrl-C or an empty line cancels.
+func (r *escapeReader) commandLine() {
+	fmt.Fprint(r.out, "\r\namz-ssh> ")
+	var line []byte
+	for {
+		b, err := r.in.ReadByte()
+		if err != nil || b == 3 {
+			fmt.Fprint(r.out, "\r\n")
+			return
+		}
+		switch b {
+		case '\r', '\n':
+			fmt.Fprint(r.out, "\r\n")
+			if err := r.run(strings.TrimSpace(string(line))); err != nil {
+				fmt.Fprintf(r.out, "%s\r\n", err)
+			}
+			return
+		case 127, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Fprint(r.out, "\b \b")
+			}
+		default:
+			line = append(line, b)
+			r.out.Write([]byte{b})
+		}
+	}
+}
+
+// run adds the forward a command line gives, eg -L 8080:localhost:80
+func (r *escapeReader) run(line string) error {
+	if line == "" {
+		return nil
+	}
+
+	var kind ForwardKind
+	switch {
+	case strings.HasPrefix(line, "-L"):
+		kind = LocalForward
+	case strings.HasPrefix(line, "-R"):
+		kind = RemoteForward
+	case strings.HasPrefix(line, "-D"):
+		kind = DynamicForward
+	default:
+		return fmt.Errorf("unknown command %q, use -L, -R or -D", line)
+	}
+
+	spec, err := ParseForwardSpec(kind, strings.TrimSpace(line[2:]))
+	if err != nil {
+		return err
+	}
+	spec.Allow = r.allow
+	forward, err := spec.Start(r.client)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forwards = append(r.forwards, forward)
+	return nil
+}
+
+// Close stops the forwards added during the session
+func (r *escapeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, forward := range r.forwards {
+		forward.Close()
+	}
+	r.forwards = nil
+	return nil
+}
@@ -0,0 +1,65 @@
+package sshutils
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+)
+
+// FIPS approved algorithms that golang.org/x/crypto/ssh supports
+var (
+	FIPSCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	FIPSMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+	}
+	FIPSKeyExchanges = []string{
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256",
+	}
+	FIPSHostKeyAlgorithms = []string{
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	}
+)
+
+// FIPSMinRSABits is the smallest RSA key that may be generated in FIPS mode
+const FIPSMinRSABits = 3072
+
+// RestrictToFIPS limits negotiation to FIPS approved algorithms. Algorithms that
+// were explicitly configured are kept, but any that aren't approved are an error.
+func (o *ClientOptions) RestrictToFIPS() error {
+	o.FIPS = true
+	var err error
+	if o.Config.Ciphers, err = fipsAlgorithms("cipher", o.Config.Ciphers, FIPSCiphers); err != nil {
+		return err
+	}
+	if o.Config.MACs, err = fipsAlgorithms("MAC", o.Config.MACs, FIPSMACs); err != nil {
+		return err
+	}
+	if o.Config.KeyExchanges, err = fipsAlgorithms("key exchange", o.Config.KeyExchanges, FIPSKeyExchanges); err != nil {
+		return err
+	}
+	if o.HostKeyAlgorithms, err = fipsAlgorithms("host key algorithm", o.HostKeyAlgorithms, FIPSHostKeyAlgorithms); err != nil {
+		return err
+	}
+	return nil
+}
+
+func fipsAlgorithms(kind string, configured, approved []string) ([]string, error) {
+	if len(configured) == 0 {
+		return approved, nil
+	}
+
+	for _, algo := range configured {
+		if !slices.Contains(approved, algo) {
+			return nil, fmt.Errorf("%s %s is not FIPS approved", kind, algo)
+		}
+	}
+	return configured, nil
+}
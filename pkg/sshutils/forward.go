@@ -0,0 +1,211 @@
+package sshutils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// ForwardKind is the kind of OpenSSH style port forward
+type ForwardKind int
+
+const (
+	// LocalForward listens locally and connects from the server, like ssh -L
+	LocalForward ForwardKind = iota
+	// RemoteForward listens on the server and connects from here, like ssh -R
+	RemoteForward
+	// DynamicForward is a local SOCKS5 proxy connecting from the server, like ssh -D
+	DynamicForward
+	// UDPForward listens for UDP datagrams locally and carries them over TCP
+	// from the server, which ssh can't forward by itself
+	UDPForward
+)
+
+// ForwardSpec is a parsed -L, -R or -D forward
+type ForwardSpec struct {
+	Kind        ForwardKind
+	BindAddress string
+	Port        int
+	// Host and HostPort are where connections are forwarded to, they are
+	// empty for dynamic forwards where the SOCKS client chooses
+	Host     string
+	HostPort int
+	// Allow restricts the targets of local and dynamic forwards
+	Allow Allowlist
+	// RawDatagrams sends UDP forward datagrams without a length prefix, for
+	// a remote relay such as socat that doesn't expect one
+	RawDatagrams bool
+}
+
+// ParseForwardSpec parses the OpenSSH forward syntax, [bind:]port:host:hostport
+// for local and remote forwards and [bind:]port for dynamic ones. IPv6
+// addresses are given in brackets and a bind address of * listens on all interfaces.
+func ParseForwardSpec(kind ForwardKind, s string) (ForwardSpec, error) {
+	spec := ForwardSpec{Kind: kind, BindAddress: "localhost"}
+	fields := splitForwardSpec(s)
+
+	var err error
+	if kind == DynamicForward {
+		switch len(fields) {
+		case 1:
+			spec.Port, err = strconv.Atoi(fields[0])
+		case 2:
+			spec.BindAddress = fields[0]
+			spec.Port, err = strconv.Atoi(fields[1])
+		default:
+			return spec, fmt.Errorf("%s is not a valid forward, use [bind:]port", s)
+		}
+	} else {
+		if len(fields) == 4 {
+			spec.BindAddress, fields = fields[0], fields[1:]
+		}
+		if len(fields) != 3 {
+			return spec, fmt.Errorf("%s is not a valid forward, use [bind:]port:host:hostport", s)
+		}
+		if spec.Port, err = strconv.Atoi(fields[0]); err == nil {
+			spec.Host = fields[1]
+			spec.HostPort, err = strconv.Atoi(fields[2])
+		}
+	}
+	if err != nil {
+		return spec, fmt.Errorf("%s is not a valid forward: %w", s, err)
+	}
+
+	if spec.BindAddress == "*" {
+		spec.BindAddress = ""
+	}
+	return spec, nil
+}
+
+// splitForwardSpec splits on the colons that aren't inside brackets, removing the brackets
+func splitForwardSpec(s string) []string {
+	var fields []string
+	var field strings.Builder
+	inBrackets := false
+	for _, r := range s {
+		switch {
+		case r == '[':
+			inBrackets = true
+		case r == ']':
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+func (s ForwardSpec) bindAddr() string {
+	return net.JoinHostPort(s.BindAddress, strconv.Itoa(s.Port))
+}
+
+func (s ForwardSpec) hostAddr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.HostPort))
+}
+
+func (s ForwardSpec) String() string {
+	if s.Kind == DynamicForward {
+		return s.bindAddr()
+	}
+	return s.bindAddr() + ":" + s.hostAddr()
+}
+
+// Start listens for the forward over client, returning once it is listening so
+// that a port in use is reported straight away, and then forwards connections
+// in the background until the returned listener is closed
+func (s ForwardSpec) Start(client *ssh.Client) (io.Closer, error) {
+	switch s.Kind {
+	case LocalForward:
+		if !s.Allow.AllowsAddr(s.hostAddr()) {
+			return nil, fmt.Errorf("forwarding to %s is not allowed by --allow", s.hostAddr())
+		}
+		listener, err := net.Listen("tcp", s.bindAddr())
+		if err != nil {
+			return nil, err
+		}
+		slog.Info(fmt.Sprintf("forwarding %s to %s", listener.Addr(), s.hostAddr()))
+		go acceptForward(listener, func() (net.Conn, error) {
+			return client.Dial(remoteNetwork(s.hostAddr()), s.hostAddr())
+		})
+		return listener, nil
+	case RemoteForward:
+		listener, err := client.Listen("tcp", s.bindAddr())
+		if err != nil {
+			return nil, fmt.Errorf("remote forward of %s refused: %w", s.bindAddr(), err)
+		}
+		slog.Info(fmt.Sprintf("forwarding remote %s to %s", s.bindAddr(), s.hostAddr()))
+		go acceptForward(listener, func() (net.Conn, error) {
+			return net.Dial(addressFamily, s.hostAddr())
+		})
+		return listener, nil
+	case DynamicForward:
+		listener, err := net.Listen("tcp", s.bindAddr())
+		if err != nil {
+			return nil, err
+		}
+		slog.Info(fmt.Sprintf("SOCKS5 proxy listening on %s", listener.Addr()))
+		go func() {
+			dial := func(network, addr string) (net.Conn, error) {
+				if !s.Allow.AllowsAddr(addr) {
+					return nil, fmt.Errorf("connecting to %s is not allowed by --allow", addr)
+				}
+				return client.Dial(network, addr)
+			}
+			if err := ServeSOCKS(listener, dial); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("SOCKS5 proxy error", "err", err)
+			}
+		}()
+		return listener, nil
+	case UDPForward:
+		return s.startUDP(client)
+	}
+	return nil, fmt.Errorf("unknown forward kind %d", s.Kind)
+}
+
+// acceptForward joins each accepted connection with a new connection from dial
+func acceptForward(listener net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				slog.Error("forward accept error", "err", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			remote, err := dial()
+			if err != nil {
+				slog.Error("forward dial error", "err", err)
+				return
+			}
+			defer remote.Close()
+			joinConns(conn, remote)
+		}()
+	}
+}
+
+// joinConns copies between a and b until either side finishes
+func joinConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyConn := func(writer, reader net.Conn) {
+		_, err := io.Copy(writer, reader)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Debug("io.Copy error", "err", err)
+		}
+		done <- struct{}{}
+	}
+	go copyConn(a, b)
+	go copyConn(b, a)
+	<-done
+}
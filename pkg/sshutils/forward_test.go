@@ -0,0 +1,102 @@
+package sshutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		kind    ForwardKind
+		in      string
+		want    ForwardSpec
+		wantErr bool
+	}{
+		{LocalForward, "5432:db.internal:5432", ForwardSpec{Kind: LocalForward, BindAddress: "localhost", Port: 5432, Host: "db.internal", HostPort: 5432}, false},
+		{LocalForward, "0.0.0.0:8080:10.0.1.5:80", ForwardSpec{Kind: LocalForward, BindAddress: "0.0.0.0", Port: 8080, Host: "10.0.1.5", HostPort: 80}, false},
+		{LocalForward, "*:8080:10.0.1.5:80", ForwardSpec{Kind: LocalForward, BindAddress: "", Port: 8080, Host: "10.0.1.5", HostPort: 80}, false},
+		{LocalForward, "[::1]:8080:[2001:db8::5]:80", ForwardSpec{Kind: LocalForward, BindAddress: "::1", Port: 8080, Host: "2001:db8::5", HostPort: 80}, false},
+		{RemoteForward, "9000:localhost:3000", ForwardSpec{Kind: RemoteForward, BindAddress: "localhost", Port: 9000, Host: "localhost", HostPort: 3000}, false},
+		{DynamicForward, "1080", ForwardSpec{Kind: DynamicForward, BindAddress: "localhost", Port: 1080}, false},
+		{DynamicForward, "*:1080", ForwardSpec{Kind: DynamicForward, BindAddress: "", Port: 1080}, false},
+		{DynamicForward, "[::]:1080", ForwardSpec{Kind: DynamicForward, BindAddress: "::", Port: 1080}, false},
+		// port ranges aren't part of the OpenSSH syntax
+		{LocalForward, "8000-8010:10.0.1.5:8000-8010", ForwardSpec{}, true},
+		{LocalForward, "5432:db.internal", ForwardSpec{}, true},
+		{LocalForward, "db:db.internal:5432", ForwardSpec{}, true},
+		{LocalForward, "2001:db8::5:5432:db.internal:5432", ForwardSpec{}, true},
+		{DynamicForward, "localhost:1080:extra", ForwardSpec{}, true},
+		{DynamicForward, "socks", ForwardSpec{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseForwardSpec(tt.kind, tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseForwardSpec(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseForwardSpec(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		allowed  []string
+		denied   []string
+		wantErr  bool
+	}{
+		{
+			patterns: []string{"10.0.0.0/16"},
+			allowed:  []string{"10.0.1.5:5432", "10.0.255.255:22"},
+			denied:   []string{"10.1.0.1:5432", "db.internal:5432"},
+		},
+		{
+			patterns: []string{"10.0.0.0/16:5432"},
+			allowed:  []string{"10.0.1.5:5432"},
+			denied:   []string{"10.0.1.5:22"},
+		},
+		{
+			patterns: []string{"10.0.1.5:*"},
+			allowed:  []string{"10.0.1.5:22", "10.0.1.5:5432"},
+			denied:   []string{"10.0.1.6:22"},
+		},
+		{
+			patterns: []string{"2001:db8::/32", "[2001:db9::5]:443"},
+			allowed:  []string{"[2001:db8::1]:22", "[2001:db9::5]:443"},
+			denied:   []string{"[2001:db9::5]:80", "[2001:dba::1]:22"},
+		},
+		{
+			patterns: []string{"*.rds.amazonaws.com:5432", "Bastion.Internal"},
+			allowed:  []string{"mydb.abc.eu-west-1.rds.amazonaws.com:5432", "bastion.internal:22"},
+			denied:   []string{"rds.amazonaws.com:5432", "mydb.abc.eu-west-1.rds.amazonaws.com:22", "10.0.1.5:5432"},
+		},
+		{
+			patterns: nil,
+			allowed:  []string{"10.0.1.5:22", "example.com:443"},
+		},
+		// port ranges aren't supported, each port needs its own pattern
+		{patterns: []string{"10.0.0.0/16:5000-5010"}, wantErr: true},
+		{patterns: []string{"10.0.0.0/16:0"}, wantErr: true},
+		{patterns: []string{"10.0.0.0/33"}, wantErr: true},
+		{patterns: []string{":22"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		allow, err := ParseAllowlist(tt.patterns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAllowlist(%q) error = %v, wantErr %v", tt.patterns, err, tt.wantErr)
+			continue
+		}
+		for _, addr := range tt.allowed {
+			if !allow.AllowsAddr(addr) {
+				t.Errorf("ParseAllowlist(%q) doesn't allow %s", tt.patterns, addr)
+			}
+		}
+		for _, addr := range tt.denied {
+			if allow.AllowsAddr(addr) {
+				t.Errorf("ParseAllowlist(%q) allows %s", tt.patterns, addr)
+			}
+		}
+	}
+}
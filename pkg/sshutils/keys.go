@@ -1,31 +1,114 @@
 package sshutils
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
+	"golang.org/x/term"
 )
 
+// Key types that can be generated and pushed via Instance Connect
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeED25519 = "ed25519"
+)
+
+// DefaultRSABits is used when no size is given, it also satisfies FIPSMinRSABits
+const DefaultRSABits = 4096
+
+// minRSABits is the smallest RSA key Instance Connect accepts
+const minRSABits = 2048
+
+// GenerateKeys returns a new PEM encoded RSA private key and its OpenSSH public key
 func GenerateKeys() (string, string, error) {
-	bitSize := 4096
-	privateKey, err := generatePrivateKey(bitSize)
-	if err != nil {
-		return "", "", err
+	return GenerateKeysWithComment("")
+}
+
+// GenerateKeysWithComment is GenerateKeys with the public key given the
+// comment, if it isn't empty
+func GenerateKeysWithComment(comment string) (string, string, error) {
+	return GenerateKeyPair(KeyTypeRSA, DefaultRSABits, comment)
+}
+
+// GenerateKeyPair is GenerateKeys for the given key type, bits is only used
+// for RSA keys
+func GenerateKeyPair(keyType string, bits int, comment string) (string, string, error) {
+	var privateKeyBytes, publicKeyBytes []byte
+	switch keyType {
+	case KeyTypeRSA, "":
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		privateKey, err := generatePrivateKey(bits)
+		if err != nil {
+			return "", "", err
+		}
+		publicKeyBytes, err = generatePublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return "", "", err
+		}
+		privateKeyBytes = encodePrivateKeyToPEM(privateKey)
+	case KeyTypeED25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		publicKeyBytes, err = generatePublicKey(publicKey)
+		if err != nil {
+			return "", "", err
+		}
+		privateKeyBytes, err = encodePKCS8PrivateKeyToPEM(privateKey)
+		if err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported key type %s, use %s or %s", keyType, KeyTypeRSA, KeyTypeED25519)
 	}
 
-	publicKeyBytes, err := generatePublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return "", "", err
+	if comment != "" {
+		publicKeyBytes = append(bytes.TrimSuffix(publicKeyBytes, []byte("\n")), []byte(" "+comment+"\n")...)
 	}
 
-	privateKeyBytes := encodePrivateKeyToPEM(privateKey)
 	return string(privateKeyBytes), string(publicKeyBytes), nil
 }
 
+// checkKeyType validates a key type and size before any key is generated
+func checkKeyType(keyType string, bits int, fips bool) error {
+	switch keyType {
+	case KeyTypeRSA, "":
+		if bits == 0 {
+			return nil
+		}
+		if bits < minRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+		if fips && bits < FIPSMinRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits in FIPS mode", FIPSMinRSABits)
+		}
+	case KeyTypeED25519:
+		if bits != 0 {
+			return errors.New("bits can't be set for ed25519 keys")
+		}
+		if fips {
+			return errors.New("ed25519 keys are not FIPS approved")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %s, use %s or %s", keyType, KeyTypeRSA, KeyTypeED25519)
+	}
+	return nil
+}
+
 // generatePrivateKey creates a RSA Private Key of specified byte size
 func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 	// Private Key generation
@@ -62,16 +145,103 @@ func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
 	return privatePEM
 }
 
-// generatePublicKey take a rsa.PublicKey and return bytes suitable for writing to .pub file
-// returns in the format "ssh-rsa ..."
-func generatePublicKey(privatekey *rsa.PublicKey) ([]byte, error) {
-	publicRsaKey, err := ssh.NewPublicKey(privatekey)
+// encodePKCS8PrivateKeyToPEM encodes private keys without a PKCS1 form, such as ed25519
+func encodePKCS8PrivateKeyToPEM(privateKey any) ([]byte, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	pubKeyBytes := ssh.MarshalAuthorizedKey(publicRsaKey)
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privDER,
+	}), nil
+}
+
+// generatePublicKey take a public key and return bytes suitable for writing to .pub file
+// returns in the format "ssh-rsa ..." or "ssh-ed25519 ..."
+func generatePublicKey(publicKey crypto.PublicKey) ([]byte, error) {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyBytes := ssh.MarshalAuthorizedKey(sshPublicKey)
 
 	slog.Debug("Public key generated")
 	return pubKeyBytes, nil
 }
+
+// LoadIdentity reads a private key file, prompting on the terminal for its
+// passphrase if it is encrypted
+func LoadIdentity(path string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var pme *ssh.PassphraseMissingError
+	if !errors.As(err, &pme) {
+		return signer, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", path)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+}
+
+// LoadCertificate reads an OpenSSH user certificate, such as one issued by
+// Vault, and pairs it with the private key it was issued for
+func LoadCertificate(path string, key ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OpenSSH certificate: %w", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key rather than a certificate", path)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", path)
+	}
+	if before := cert.ValidBefore; before != ssh.CertTimeInfinity && time.Now().Unix() >= int64(before) {
+		return nil, fmt.Errorf("%s expired at %s", path, time.Unix(int64(before), 0).Format(time.RFC3339))
+	}
+
+	return ssh.NewCertSigner(cert, key)
+}
+
+// SignUserCertificate issues a certificate for key that lets it log in as
+// principal until validity has passed, for servers that trust ca through
+// TrustedUserCAKeys. It's valid from a minute ago to allow for clock skew.
+func SignUserCertificate(key ssh.PublicKey, ca ssh.Signer, principal, keyID string, validity time.Duration) (*ssh.Certificate, error) {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           keyID,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":             "",
+				"permit-port-forwarding": "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, fmt.Errorf("unable to sign certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,45 @@
+package sshutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtocolSignature is the fixed signature every PROXY protocol v2 header starts with
+var proxyProtocolSignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtocolHeader builds a PROXY protocol v2 header describing a TCP
+// connection from src to dst, so that the backend sees the original client
+func proxyProtocolHeader(src, dst net.Addr) ([]byte, error) {
+	srcAddr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported source address %s for proxy protocol", src)
+	}
+	dstAddr, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported destination address %s for proxy protocol", dst)
+	}
+
+	// version 2, PROXY command
+	header := append([]byte{}, proxyProtocolSignature...)
+	header = append(header, 0x21)
+
+	if src4, dst4 := srcAddr.IP.To4(), dstAddr.IP.To4(); src4 != nil && dst4 != nil {
+		// TCP over IPv4
+		header = append(header, 0x11)
+		header = binary.BigEndian.AppendUint16(header, 12)
+		header = append(header, src4...)
+		header = append(header, dst4...)
+	} else {
+		// TCP over IPv6
+		header = append(header, 0x21)
+		header = binary.BigEndian.AppendUint16(header, 36)
+		header = append(header, srcAddr.IP.To16()...)
+		header = append(header, dstAddr.IP.To16()...)
+	}
+
+	header = binary.BigEndian.AppendUint16(header, uint16(srcAddr.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstAddr.Port))
+	return header, nil
+}
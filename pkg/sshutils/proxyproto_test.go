@@ -0,0 +1,67 @@
+package sshutils
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	signature := string(proxyProtocolSignature)
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     []byte
+		wantErr  bool
+	}{
+		{
+			name: "IPv4",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("10.0.1.5"), Port: 5432},
+			want: []byte(signature + "\x21\x11\x00\x0c" +
+				"\xc0\x00\x02\x0a" + "\x0a\x00\x01\x05" +
+				"\xc8\x22" + "\x15\x38"),
+		},
+		{
+			name: "IPv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 443},
+			want: []byte(signature + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x10" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05" +
+				"\xc8\x22" + "\x01\xbb"),
+		},
+		{
+			// a mixed pair is described as IPv6, with the IPv4 address mapped
+			name: "mixed",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 443},
+			want: []byte(signature + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x0a" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05" +
+				"\xc8\x22" + "\x01\xbb"),
+		},
+		{
+			name:    "unix socket",
+			src:     &net.UnixAddr{Name: "/tmp/amz-ssh.sock", Net: "unix"},
+			dst:     &net.TCPAddr{IP: net.ParseIP("10.0.1.5"), Port: 5432},
+			wantErr: true,
+		},
+		{
+			name:    "UDP destination",
+			src:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234},
+			dst:     &net.UDPAddr{IP: net.ParseIP("10.0.1.5"), Port: 53},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := proxyProtocolHeader(tt.src, tt.dst)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: proxyProtocolHeader() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: proxyProtocolHeader() = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
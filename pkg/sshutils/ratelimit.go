@@ -0,0 +1,124 @@
+package sshutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket allowing a number of units per second with a
+// burst of one second's worth of units, or a single unit for slower rates
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	burst := perSecond
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// WaitN takes n units from the bucket, blocking until they have been earned
+func (r *RateLimiter) WaitN(n int) {
+	time.Sleep(r.reserve(n))
+}
+
+// Wait is WaitN that gives up when ctx is done, returning the units it took
+// to the bucket so they aren't lost
+func (r *RateLimiter) Wait(ctx context.Context, n int) error {
+	wait := r.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		r.tokens += float64(n)
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve takes n units from the bucket and returns how long it is until
+// they have been earned
+func (r *RateLimiter) reserve(n int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens -= float64(n)
+
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// Reader wraps reader so reads are limited to the limiter's rate in bytes per second
+func (r *RateLimiter) Reader(reader io.Reader) io.Reader {
+	return &rateLimitedReader{reader: reader, limiter: r}
+}
+
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	// keep reads within a single burst so low rates don't stall on one large read
+	if burst := int(l.limiter.rate); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := l.reader.Read(p)
+	l.limiter.WaitN(n)
+	return n, err
+}
+
+// ParseRate parses a human readable rate such as 1MB/s or 512K into bytes per second
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	v = strings.TrimSuffix(v, "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s is not a valid rate, use a value such as 1MB/s", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
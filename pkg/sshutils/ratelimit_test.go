@@ -0,0 +1,57 @@
+package sshutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := NewRateLimiter(0.1)
+	if err := limiter.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next unit is ten seconds away
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait() = %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Wait() took %s after its context was done", elapsed)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1MB/s", 1 << 20, false},
+		{"1MB/S", 1 << 20, false},
+		{"1mb/s", 1 << 20, false},
+		{"512K", 512 << 10, false},
+		{"512kb", 512 << 10, false},
+		{"1.5G", 3 << 29, false},
+		{"100", 100, false},
+		{" 2M/s ", 2 << 20, false},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"fast", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
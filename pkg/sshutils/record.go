@@ -0,0 +1,90 @@
+package sshutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Recorder writes what a shell session shows to an asciinema v2 cast file,
+// see https://docs.asciinema.org/manual/asciicast/v2/
+type Recorder struct {
+	w       io.Writer
+	mu      sync.Mutex
+	start   time.Time
+	pending []byte
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Start writes the cast's header for a terminal of the given size, events
+// are timed from when it's called
+func (r *Recorder) Start(width, height int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.start = time.Now()
+	header, err := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": r.start.Unix(),
+		"env": map[string]string{
+			"SHELL": os.Getenv("SHELL"),
+			"TERM":  "xterm-256color",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", header)
+	return err
+}
+
+// Write records p as output, a multi-byte character split between writes is
+// held back until the rest of it arrives so it isn't mangled
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending, p...)
+	n := len(data)
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[n:]...)
+
+	if n > 0 {
+		if err := r.event("o", string(data[:n])); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Resize records the terminal changing size
+func (r *Recorder) Resize(width, height int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *Recorder) event(kind, data string) error {
+	line, err := json.Marshal([]any{time.Since(r.start).Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", line)
+	return err
+}
@@ -0,0 +1,75 @@
+package sshutils
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// addressFamily is the network connections are dialled over, tcp4 or tcp6
+// restrict them to one address family
+var addressFamily = "tcp"
+
+// SetAddressFamily restricts dialling to inet for IPv4 or inet6 for IPv6, for
+// dual-stack networks where only one is allowed through. auto uses either.
+func SetAddressFamily(family string) error {
+	switch family {
+	case "", "auto":
+		addressFamily = "tcp"
+	case "inet":
+		addressFamily = "tcp4"
+	case "inet6":
+		addressFamily = "tcp6"
+	default:
+		return fmt.Errorf("%s is not an address family, use inet, inet6 or auto", family)
+	}
+	return nil
+}
+
+// remoteNetwork is the network to dial addr over through an ssh client. The
+// ssh package resolves names here for tcp4 and tcp6, so they are only used for
+// IP addresses and names are still sent on for the far end to resolve.
+func remoteNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "tcp"
+	}
+	return addressFamily
+}
+
+// NewResolver returns a resolver that sends its queries to server, an IP
+// with an optional port, instead of the system's resolvers
+func NewResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// resolveAddr replaces the host name of addr with its first address of the
+// address family from resolver, IP addresses are returned as they are
+func resolveAddr(ctx context.Context, resolver *net.Resolver, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	network := "ip"
+	if addressFamily != "tcp" {
+		network = "ip" + addressFamily[3:]
+	}
+	addrs, err := resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %s locally: %w", host, err)
+	}
+	return net.JoinHostPort(addrs[0].String(), port), nil
+}
@@ -0,0 +1,68 @@
+package sshutils
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// SharedClient is a connection to the bastion shared by every Forwarder and
+// the shell. When it's found dead it's dialled again once for all of them,
+// rather than by each one that notices.
+type SharedClient struct {
+	// Redial connects to the bastion again, without it a dead connection
+	// stays dead
+	Redial func() (*ssh.Client, error)
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// checking is held for a whole Check, so that only the first of several
+	// concurrent checks redials and the rest see the new connection
+	checking sync.Mutex
+}
+
+func NewSharedClient(client *ssh.Client, redial func() (*ssh.Client, error)) *SharedClient {
+	return &SharedClient{client: client, Redial: redial}
+}
+
+// Client returns the current connection
+func (s *SharedClient) Client() *ssh.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// Check sends a keepalive and when it fails replaces the connection with a
+// new one from Redial, reporting whether it did
+func (s *SharedClient) Check() (bool, error) {
+	s.checking.Lock()
+	defer s.checking.Unlock()
+
+	client := s.Client()
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err == nil {
+		return false, nil
+	}
+	slog.Warn("bastion connection lost", "err", err)
+	if s.Redial == nil {
+		return false, errors.New("bastion connection lost and there's no way to reconnect")
+	}
+
+	next, err := s.Redial()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.client = next
+	s.mu.Unlock()
+	client.Close()
+	return true, nil
+}
+
+// Close closes the current connection
+func (s *SharedClient) Close() error {
+	return s.Client().Close()
+}
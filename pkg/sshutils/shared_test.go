@@ -0,0 +1,107 @@
+package sshutils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer accepts ssh connections without authentication, answering
+// nothing but keepalives, and returns its address and the server side of
+// each connection
+func testSSHServer(t *testing.T) (string, <-chan ssh.Conn) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	conns := make(chan ssh.Conn, 10)
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+				if err != nil {
+					return
+				}
+				conns <- conn
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), conns
+}
+
+func TestSharedClientRedialsOnce(t *testing.T) {
+	addr, conns := testSSHServer(t)
+	var dials atomic.Int64
+	dial := func() (*ssh.Client, error) {
+		dials.Add(1)
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "ec2-user", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	}
+
+	client, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewSharedClient(client, dial)
+	defer shared.Close()
+
+	if reconnected, err := shared.Check(); err != nil || reconnected {
+		t.Fatalf("Check() on a live connection = %v, %v", reconnected, err)
+	}
+
+	// the bastion drops the connection, every tunnel's heartbeat notices
+	(<-conns).Close()
+	client.Wait()
+
+	var wg sync.WaitGroup
+	var reconnects atomic.Int64
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reconnected, err := shared.Check()
+			if err != nil {
+				t.Error(err)
+			}
+			if reconnected {
+				reconnects.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := reconnects.Load(); got != 1 {
+		t.Errorf("reconnected %d times, want 1", got)
+	}
+	if got := dials.Load(); got != 2 {
+		t.Errorf("dialled %d times, want 2", got)
+	}
+	if shared.Client() == client {
+		t.Error("the dead connection wasn't replaced")
+	}
+}
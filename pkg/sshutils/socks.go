@@ -0,0 +1,136 @@
+package sshutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/exp/slog"
+)
+
+// SOCKS5 protocol values from RFC 1928, only what's needed for CONNECT
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksAtypIPv4        = 1
+	socksAtypDomain      = 3
+	socksAtypIPv6        = 4
+	socksSucceeded       = 0
+	socksGeneralFailure  = 1
+	socksCmdUnsupported  = 7
+	socksAtypUnsupported = 8
+)
+
+// ServeSOCKS runs a minimal SOCKS5 proxy, without authentication and only
+// supporting CONNECT, that makes its connections with dial
+func ServeSOCKS(listener net.Listener, dial func(network, addr string) (net.Conn, error)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			remote, err := socksHandshake(conn, dial)
+			if err != nil {
+				slog.Debug("SOCKS5 request failed", "err", err)
+				return
+			}
+			defer remote.Close()
+			joinConns(conn, remote)
+		}()
+	}
+}
+
+// socksHandshake negotiates with the client and connects to the address it asks for
+func socksHandshake(conn net.Conn, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoAcceptable {
+		return nil, errors.New("client requires authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCmdUnsupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAtypUnsupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	remote, err := dial("tcp", addr)
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	slog.Debug("SOCKS5 connected to " + addr)
+	return remote, nil
+}
+
+// socksReply answers a request, the bound address isn't meaningful through
+// the ssh connection so it is always reported as 0.0.0.0:0
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
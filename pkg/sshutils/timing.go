@@ -0,0 +1,33 @@
+package sshutils
+
+import (
+	"sync"
+	"time"
+)
+
+// Timing is how long one phase of connecting took
+type Timing struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// timings records the phases of connecting as they happen, so a slow
+// connection can be blamed on the AWS APIs or the network
+var timings struct {
+	sync.Mutex
+	recorded []Timing
+}
+
+// RecordTiming adds how long phase took since start to the timings
+func RecordTiming(phase string, start time.Time) {
+	timings.Lock()
+	defer timings.Unlock()
+	timings.recorded = append(timings.recorded, Timing{Phase: phase, Duration: time.Since(start)})
+}
+
+// Timings returns the phases recorded so far, in the order they finished
+func Timings() []Timing {
+	timings.Lock()
+	defer timings.Unlock()
+	return append([]Timing(nil), timings.recorded...)
+}
@@ -0,0 +1,144 @@
+package sshutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+)
+
+// udpIdleTimeout closes a UDP client's stream once it has been quiet this long
+const udpIdleTimeout = 2 * time.Minute
+
+// maxDatagram is the largest UDP payload
+const maxDatagram = 65535
+
+// startUDP listens for datagrams locally and carries them over client to
+// the forward's host, on one TCP stream per local UDP client. Unless
+// RawDatagrams is set each datagram is sent with a two byte length prefix,
+// the framing DNS over TCP uses, so a DNS server can be queried directly.
+func (s ForwardSpec) startUDP(client *ssh.Client) (io.Closer, error) {
+	if !s.Allow.AllowsAddr(s.hostAddr()) {
+		return nil, fmt.Errorf("forwarding to %s is not allowed by --allow", s.hostAddr())
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.bindAddr())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info(fmt.Sprintf("forwarding UDP %s to %s over TCP", conn.LocalAddr(), s.hostAddr()))
+	go s.serveUDP(conn, func() (net.Conn, error) {
+		return client.Dial(remoteNetwork(s.hostAddr()), s.hostAddr())
+	})
+	return conn, nil
+}
+
+// udpStream is the TCP stream carrying a local UDP client's datagrams
+type udpStream struct {
+	net.Conn
+	idle *time.Timer
+}
+
+func (s ForwardSpec) serveUDP(conn *net.UDPConn, dial func() (net.Conn, error)) {
+	var mu sync.Mutex
+	streams := map[string]*udpStream{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("UDP forward read error", "err", err)
+			}
+			return
+		}
+
+		mu.Lock()
+		stream, ok := streams[peer.String()]
+		if !ok {
+			remote, err := dial()
+			if err != nil {
+				mu.Unlock()
+				slog.Error("forward dial error", "err", err)
+				continue
+			}
+			stream = &udpStream{Conn: remote, idle: time.AfterFunc(udpIdleTimeout, func() { remote.Close() })}
+			streams[peer.String()] = stream
+			go func(peer *net.UDPAddr) {
+				s.udpReplies(conn, peer, stream)
+				stream.Close()
+				mu.Lock()
+				delete(streams, peer.String())
+				mu.Unlock()
+			}(peer)
+		}
+		mu.Unlock()
+
+		stream.idle.Reset(udpIdleTimeout)
+		if err := s.writeDatagram(stream, buf[:n]); err != nil {
+			slog.Debug("UDP forward write error", "err", err)
+			stream.Close()
+		}
+	}
+}
+
+// writeDatagram sends a datagram over the stream, framed unless RawDatagrams is set
+func (s ForwardSpec) writeDatagram(w io.Writer, datagram []byte) error {
+	if s.RawDatagrams {
+		_, err := w.Write(datagram)
+		return err
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// udpReplies sends what comes back over the stream to the local UDP client
+// until the stream is closed
+func (s ForwardSpec) udpReplies(conn *net.UDPConn, peer *net.UDPAddr, stream *udpStream) {
+	buf := make([]byte, maxDatagram)
+	for {
+		var n int
+		var err error
+		if s.RawDatagrams {
+			// without framing each read is taken to be a datagram
+			n, err = stream.Read(buf)
+		} else {
+			var size [2]byte
+			if _, err = io.ReadFull(stream, size[:]); err == nil {
+				n = int(binary.BigEndian.Uint16(size[:]))
+				_, err = io.ReadFull(stream, buf[:n])
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("UDP forward read error", "err", err)
+			}
+			return
+		}
+
+		stream.idle.Reset(udpIdleTimeout)
+		if _, err := conn.WriteToUDP(buf[:n], peer); err != nil {
+			slog.Debug("UDP forward write error", "err", err)
+			return
+		}
+	}
+}
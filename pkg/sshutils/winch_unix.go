@@ -0,0 +1,31 @@
+//go:build !windows
+
+package sshutils
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchWindowSize calls resize with the terminal's new size whenever it
+// changes, until done is closed
+func watchWindowSize(fd int, done <-chan struct{}, resize func(width, height int)) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-done:
+				return
+			case <-c:
+				if width, height, err := term.GetSize(fd); err == nil {
+					resize(width, height)
+				}
+			}
+		}
+	}()
+}
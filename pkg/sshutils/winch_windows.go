@@ -0,0 +1,4 @@
+package sshutils
+
+// watchWindowSize does nothing as Windows has no SIGWINCH
+func watchWindowSize(fd int, done <-chan struct{}, resize func(width, height int)) {}
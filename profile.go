@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// profile is a named set of flags and destinations, eg
+//
+//	{
+//	  "prod-db": {
+//	    "flags": {"region": "eu-west-1", "tunnel": "db.internal:5432", "use-private": true},
+//	    "destinations": []
+//	  }
+//	}
+type profile struct {
+	Flags        map[string]any `json:"flags"`
+	Destinations []string       `json:"destinations"`
+}
+
+func defaultProfilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "amz-ssh", "profiles.json")
+}
+
+func loadProfiles(path string) (map[string]profile, error) {
+	if path == "" {
+		return nil, errors.New("no profiles file, set --profiles")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no profiles file at %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// useProfile runs a connection with the flags and destinations of the named
+// profile, flags given on the command line take precedence over the profile
+func useProfile(c *cli.Context) error {
+	profiles, err := loadProfiles(c.String("profiles"))
+	if err != nil {
+		return err
+	}
+
+	name := c.Args().First()
+	if name == "" {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(c.App.Writer, strings.Join(names, "\n"))
+		return nil
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile named %s in %s", name, c.String("profiles"))
+	}
+
+	for flag, value := range p.Flags {
+		if c.IsSet(flag) {
+			continue
+		}
+
+		values := []any{value}
+		if list, ok := value.([]any); ok {
+			values = list
+		}
+		for _, v := range values {
+			if err := c.Set(flag, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("profile %s: unable to set %s: %w", name, flag, err)
+			}
+		}
+	}
+
+	return connect(c, append(p.Destinations, c.Args().Tail()...))
+}
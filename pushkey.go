@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// pushKey authorizes a key on an instance for another tool to connect with,
+// the instance is the destination argument, --instance-id or found by --tag
+func pushKey(c *cli.Context) error {
+	cfg, err := loadConfig(c.Context, c.String("region"), c.Bool("sso-login"), c.Bool("trace-aws"))
+	if err != nil {
+		return err
+	}
+	clients := sshutils.NewClients(cfg)
+	awsTimeout := c.Duration("aws-timeout")
+	ctx, cancel := withTimeout(c.Context, awsTimeout)
+	defer cancel()
+
+	dest := c.Args().First()
+	if dest == "" {
+		dest = c.String("instance-id")
+	}
+	if dest == "" {
+		tagName, tagValue, err := parseTag(c.String("tag"))
+		if err != nil {
+			return err
+		}
+		if dest, err = resolveInstanceIDByTag(ctx, clients.EC2(""), tagName, tagValue, shuffleInstances); err != nil {
+			return timeoutError(err, awsTimeout)
+		}
+	}
+	if dest, err = resolveTagDestination(ctx, clients, dest, shuffleInstances); err != nil {
+		return timeoutError(err, awsTimeout)
+	}
+
+	opts := []sshutils.EC2EndpointOption{sshutils.WithClients(clients)}
+	var publicKey string
+	if path := c.String("public-key"); path != "" {
+		if publicKey, err = readPublicKey(path); err != nil {
+			return err
+		}
+		opts = append(opts, sshutils.WithoutKeys())
+	} else if c.String("key-comment") != "" {
+		comment, err := keyComment(ctx, cfg, c.String("key-comment"))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, sshutils.WithKeyComment(comment))
+	}
+	endpoint, err := sshutils.NewEC2Endpoint(ctx, dest, clients.EC2(""), clients.Connect(""), opts...)
+	if err != nil {
+		return timeoutError(err, awsTimeout)
+	}
+	if addr, _, _ := strings.Cut(dest, ","); !strings.Contains(addr, "@") {
+		endpoint.User = c.String("user")
+	}
+	endpoint.ConnectUser = c.String("connect-user")
+	if publicKey != "" {
+		endpoint.PublicKey = publicKey
+	}
+
+	if err := endpoint.PushKey(ctx); err != nil {
+		return timeoutError(err, awsTimeout)
+	}
+	slog.Info(fmt.Sprintf("key pushed to %s, it can be used to connect for 60 seconds", endpoint.InstanceID))
+
+	fmt.Fprint(c.App.Writer, endpoint.PrivateKey)
+	return nil
+}
+
+// readPublicKey reads an OpenSSH public key from a file, or stdin for -, and
+// checks that it is well formed before it's sent
+func readPublicKey(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read public key: %w", err)
+	}
+
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%s is not an OpenSSH public key: %w", path, err)
+	}
+	// only the first key is sent, without any authorized_keys options
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)) + " " + comment), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// readHostsFile reads the destinations for --hosts-file, one per line in any
+// form a destination argument takes, blank lines and # comments are skipped
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s has no hosts in it", path)
+	}
+	return hosts, nil
+}
+
+// hostOutput is where each host's command output goes
+type hostOutput struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	// Prefix labels each line with the host's id or name, or is none
+	Prefix string
+	// Buffer holds a host's output back until its command has finished, so
+	// that hosts' output isn't interleaved
+	Buffer bool
+
+	mu sync.Mutex
+}
+
+// runOnHosts runs command on the last hop of each chain, on up to concurrency
+// at once and over the one bastion client. A single chain's exit status is
+// returned as is so that amz-ssh exits with it, otherwise the failures are counted.
+func runOnHosts(bastion *ssh.Client, chains [][]sshutils.EndpointIface, command string, concurrency int, output *hostOutput) error {
+	errs := make([]error, len(chains))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, chain := range chains {
+		wg.Add(1)
+		go func(i int, chain []sshutils.EndpointIface) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = output.run(bastion, chain, command)
+		}(i, chain)
+	}
+	wg.Wait()
+
+	if len(chains) == 1 {
+		return errs[0]
+	}
+
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			slog.Error("command failed", "host", describeChain(chains[i]), "err", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d hosts", failed, len(chains))
+	}
+	return nil
+}
+
+// run runs command on the host chain ends on, writing its output as configured
+func (o *hostOutput) run(bastion *ssh.Client, chain []sshutils.EndpointIface, command string) error {
+	prefix := ""
+	if label := hostLabel(chain, o.Prefix); label != "" {
+		prefix = label + ": "
+	}
+
+	stdout, stderr := o.writer(o.Stdout, prefix), o.writer(o.Stderr, prefix)
+	err := runOnHost(bastion, chain, command, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+func (o *hostOutput) writer(w io.Writer, prefix string) *lineWriter {
+	if o.Buffer {
+		return &lineWriter{w: &bytes.Buffer{}, mu: &sync.Mutex{}, prefix: prefix, flushTo: w, flushMu: &o.mu}
+	}
+	return &lineWriter{w: w, mu: &o.mu, prefix: prefix}
+}
+
+// lineWriter writes whole lines to w, each starting with prefix, so that
+// lines from several hosts aren't mixed together. When flushTo is set w is a
+// buffer that's copied to it by Flush.
+type lineWriter struct {
+	w       io.Writer
+	mu      *sync.Mutex
+	prefix  string
+	partial []byte
+
+	flushTo io.Writer
+	flushMu *sync.Mutex
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.writeLine(l.partial[:i+1]); err != nil {
+			return 0, err
+		}
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintf(l.w, "%s%s", l.prefix, line)
+	return err
+}
+
+// Flush writes out a last line without a newline, and the buffered output
+func (l *lineWriter) Flush() {
+	if len(l.partial) > 0 {
+		l.writeLine(append(l.partial, '\n'))
+		l.partial = nil
+	}
+	if l.flushTo != nil {
+		l.flushMu.Lock()
+		defer l.flushMu.Unlock()
+		io.Copy(l.flushTo, l.w.(*bytes.Buffer))
+	}
+}
+
+// hostLabel returns what --output-prefix labels a host's lines with
+func hostLabel(chain []sshutils.EndpointIface, prefix string) string {
+	if prefix == "none" {
+		return ""
+	}
+	if len(chain) == 0 {
+		return "bastion"
+	}
+
+	switch e := chain[len(chain)-1].(type) {
+	case *sshutils.EC2Endpoint:
+		if name := instanceName(*e.Instance); prefix == "name" && name != "" {
+			return name
+		}
+		return e.InstanceID
+	case *sshutils.Endpoint:
+		return e.Host
+	}
+	return chain[len(chain)-1].String()
+}
+
+func runOnHost(bastion *ssh.Client, chain []sshutils.EndpointIface, command string, stdout, stderr io.Writer) error {
+	client, err := sshutils.DialFrom(bastion, chain...)
+	if err != nil {
+		return err
+	}
+	if client != bastion {
+		defer client.Close()
+	}
+	slog.Debug("connected via " + sshutils.Path(client))
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create new session: %w", err)
+	}
+	defer sess.Close()
+
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+	return sess.Run(command)
+}
+
+// describeChain names the host a chain ends on, the bastion when it's empty
+func describeChain(chain []sshutils.EndpointIface) string {
+	if len(chain) == 0 {
+		return "bastion"
+	}
+	return describeEndpoint(chain[len(chain)-1])
+}
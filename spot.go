@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/exp/slog"
+)
+
+// interruptionStatusCodes are the spot request statuses of an instance that
+// has been given an interruption notice and will soon be stopped or terminated
+var interruptionStatusCodes = []string{"marked-for-stop", "marked-for-termination", "marked-for-stop-by-experiment"}
+
+// getInterruptedSpotInstances returns the ids of the instances with the tag
+// whose spot requests have a pending interruption
+func getInterruptedSpotInstances(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string) (map[string]bool, error) {
+	interrupted := map[string]bool{}
+	paginator := ec2.NewDescribeSpotInstanceRequestsPaginator(ec2Client, &ec2.DescribeSpotInstanceRequestsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("tag:" + tagName),
+				Values: []string{tagValue},
+			},
+			{
+				Name:   aws.String("status-code"),
+				Values: interruptionStatusCodes,
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, sir := range page.SpotInstanceRequests {
+			interrupted[aws.ToString(sir.InstanceId)] = true
+		}
+	}
+	return interrupted, nil
+}
+
+// avoidInterruptions reorders the bastion candidates so that spot instances
+// with a pending interruption are tried last. Their requests are no longer
+// fulfilled, so they aren't among ids, and the ones still running are added
+// back at the end. When there are any, running on-demand instances with the
+// tag are tried first, as the spot requests being interrupted suggest the
+// others may follow.
+func avoidInterruptions(ctx context.Context, ec2Client *ec2.Client, tagName, tagValue string, ids []string, order instanceOrder) ([]string, error) {
+	interrupted, err := getInterruptedSpotInstances(ctx, ec2Client, tagName, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(interrupted) == 0 {
+		return ids, nil
+	}
+
+	instances, err := getInstanceByTag(ctx, ec2Client, tagName, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	var onDemand, marked []string
+	for _, instance := range instances {
+		id := aws.ToString(instance.InstanceId)
+		if instance.InstanceLifecycle != ec2types.InstanceLifecycleTypeSpot {
+			onDemand = append(onDemand, id)
+		} else if interrupted[id] {
+			marked = append(marked, id)
+		}
+	}
+	order(onDemand)
+	order(marked)
+
+	seen := map[string]bool{}
+	var preferred, last []string
+	for _, id := range append(append(onDemand, ids...), marked...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if interrupted[id] {
+			slog.Debug("Avoiding spot instance with a pending interruption", "instance", id)
+			last = append(last, id)
+		} else {
+			preferred = append(preferred, id)
+		}
+	}
+	return append(preferred, last...), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+func TestAvoidInterruptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		switch action := r.Form.Get("Action"); action {
+		case "DescribeSpotInstanceRequests":
+			fmt.Fprint(w, `<DescribeSpotInstanceRequestsResponse><spotInstanceRequestSet>`+
+				`<item><instanceId>i-marked</instanceId></item>`+
+				`</spotInstanceRequestSet></DescribeSpotInstanceRequestsResponse>`)
+		case "DescribeInstances":
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>`+
+				`<item><instanceId>i-spot</instanceId><instanceLifecycle>spot</instanceLifecycle></item>`+
+				`<item><instanceId>i-marked</instanceId><instanceLifecycle>spot</instanceLifecycle></item>`+
+				`<item><instanceId>i-ondemand</instanceId></item>`+
+				`</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+		default:
+			t.Errorf("unexpected %s request", action)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client := ec2.New(ec2.Options{
+		Region:           "eu-west-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: ec2.EndpointResolverFromURL(srv.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+
+	// only fulfilled spot requests are candidates, so i-marked isn't one
+	got, err := avoidInterruptions(context.Background(), client, "role", "bastion", []string{"i-spot"}, func([]string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"i-ondemand", "i-spot", "i-marked"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("avoidInterruptions() = %v, want %v", got, want)
+	}
+}
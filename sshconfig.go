@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sshConfig is the subset of an OpenSSH client config that amz-ssh reads,
+// the Host blocks with their settings. Match blocks are skipped.
+type sshConfig struct {
+	hosts []sshConfigHost
+}
+
+type sshConfigHost struct {
+	patterns []string
+	settings map[string]string
+}
+
+// maxIncludeDepth stops Include loops, as ssh itself does
+const maxIncludeDepth = 16
+
+// loadSSHConfig reads an ssh_config file and the files it includes
+func loadSSHConfig(file string) (*sshConfig, error) {
+	cfg := &sshConfig{}
+	if err := cfg.read(file, []string{"*"}, 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// read adds the blocks in file, settings before its first Host block belong
+// to the block given by patterns, the one it's included from
+func (c *sshConfig) read(file string, patterns []string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested Includes", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.hosts = append(c.hosts, sshConfigHost{patterns: patterns, settings: map[string]string{}})
+	current := &c.hosts[len(c.hosts)-1]
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.ContainsAny(key, " \t") {
+			key, value, _ = strings.Cut(strings.Replace(line, "\t", " ", 1), " ")
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch key {
+		case "host":
+			c.hosts = append(c.hosts, sshConfigHost{patterns: strings.Fields(value), settings: map[string]string{}})
+			current = &c.hosts[len(c.hosts)-1]
+		case "match":
+			// Match conditions aren't evaluated, so their settings are ignored
+			c.hosts = append(c.hosts, sshConfigHost{settings: map[string]string{}})
+			current = &c.hosts[len(c.hosts)-1]
+		case "include":
+			// the included files' settings belong to the block the Include is in
+			patterns := current.patterns
+			for _, pattern := range strings.Fields(value) {
+				matches, err := filepath.Glob(includePath(pattern))
+				if err != nil {
+					return fmt.Errorf("%s: %w", file, err)
+				}
+				for _, match := range matches {
+					if err := c.read(match, patterns, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// an Include leaves the block it's in open
+			c.hosts = append(c.hosts, sshConfigHost{patterns: patterns, settings: map[string]string{}})
+			current = &c.hosts[len(c.hosts)-1]
+		default:
+			// the first value given for a setting is the one that's used
+			if _, set := current.settings[key]; !set {
+				current.settings[key] = value
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// expandHome expands a leading ~ to the home directory, as ssh -F does
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
+
+// includePath expands ~ and makes relative paths relative to ~/.ssh, as
+// ssh does for Include
+func includePath(p string) string {
+	p = expandHome(p)
+	if filepath.IsAbs(p) {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, ".ssh", p)
+}
+
+// defaults returns the User and Port the config has for any of names, such as
+// an instance id and its address, empty and 0 when it has none. A nil config
+// has no defaults.
+func (c *sshConfig) defaults(names ...string) (string, int) {
+	if c == nil {
+		return "", 0
+	}
+	port, _ := strconv.Atoi(c.Get(names, "Port"))
+	return c.Get(names, "User"), port
+}
+
+// Get returns the first value of key from the Host blocks matching any of
+// names, or an empty string
+func (c *sshConfig) Get(names []string, key string) string {
+	key = strings.ToLower(key)
+	for _, host := range c.hosts {
+		value, ok := host.settings[key]
+		if ok && host.matches(names) {
+			return value
+		}
+	}
+	return ""
+}
+
+// matches reports whether a name matches the block's patterns and isn't
+// excluded by one of its !patterns
+func (h sshConfigHost) matches(names []string) bool {
+	var matched bool
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, pattern := range h.patterns {
+			negated := strings.HasPrefix(pattern, "!")
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), name); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
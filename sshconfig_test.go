@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHConfigPaths(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		path          string
+		flag, include string
+	}{
+		{"~", home, home},
+		{"~/.ssh/config", filepath.Join(home, ".ssh/config"), filepath.Join(home, ".ssh/config")},
+		{"/etc/ssh/ssh_config", "/etc/ssh/ssh_config", "/etc/ssh/ssh_config"},
+		// only Include is relative to ~/.ssh, --ssh-config is relative to the
+		// working directory like ssh -F
+		{"config.d/work", "config.d/work", filepath.Join(home, ".ssh/config.d/work")},
+		{"~user/config", "~user/config", filepath.Join(home, ".ssh/~user/config")},
+	}
+	for _, tt := range tests {
+		if got := expandHome(tt.path); got != tt.flag {
+			t.Errorf("expandHome(%q) = %q, want %q", tt.path, got, tt.flag)
+		}
+		if got := includePath(tt.path); got != tt.include {
+			t.Errorf("includePath(%q) = %q, want %q", tt.path, got, tt.include)
+		}
+	}
+}
+
+func TestSSHConfigIncludeInheritsHost(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	write("bastion", "User admin\nPort 2222\n")
+	write("other", "Host 10.*\nUser ubuntu\n")
+	config := write("config", "Host i-*\nInclude "+filepath.Join(dir, "bastion")+"\nInclude "+filepath.Join(dir, "other")+"\nHost *\nUser ec2-user\n")
+
+	cfg, err := loadSSHConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		port int
+	}{
+		{"i-0eaa4d1c7f350216e", "admin", 2222},
+		{"10.0.3.25", "ubuntu", 0},
+		{"example.com", "ec2-user", 0},
+	}
+	for _, tt := range tests {
+		if user, port := cfg.defaults(tt.name); user != tt.user || port != tt.port {
+			t.Errorf("defaults(%q) = %q, %d, want %q, %d", tt.name, user, port, tt.user, tt.port)
+		}
+	}
+}
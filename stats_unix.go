@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// logStatsOnSignal logs the tunnels' connection count and bytes transferred
+// whenever SIGUSR1 is received, without interrupting them
+func logStatsOnSignal(fwds []*sshutils.Forwarder) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			var active, transferred int64
+			for _, fwd := range fwds {
+				a, t := fwd.Stats()
+				active, transferred = active+a, transferred+t
+			}
+			slog.Info(fmt.Sprintf("tunnels have %d active connections, %d bytes transferred", active, transferred))
+		}
+	}()
+}
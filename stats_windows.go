@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/mintel/amz-ssh/pkg/sshutils"
+)
+
+// logStatsOnSignal does nothing as Windows has no SIGUSR1
+func logStatsOnSignal(fwds []*sshutils.Forwarder) {}